@@ -77,25 +77,24 @@ func EditMutableContextValue[V any](ctx context.Context, key MutableContextKey[V
 	}
 }
 
+func (m *MutableContext) tryGet(key any) (any, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	res, ok := m.values[key]
+	return res, ok
+}
+
+// TryGetMutableContextValue returns the value from the innermost mutable context that has
+// it. It returns false if the value is not found or if there is no mutable context at all.
 func TryGetMutableContextValue[V any](ctx context.Context, key MutableContextKey[V]) (V, bool) {
 	var none V
 
-	tryGet := func(curM *MutableContext) (V, bool) {
-		curM.mtx.Lock()
-		defer curM.mtx.Unlock()
-		res, ok := curM.values[key]
-		if ok {
-			return res.(V), true
-		}
-		return none, false
-	}
-
-	m := mustGetMutableContext(ctx)
+	m := tryGetMutableContext(ctx)
 
 	for m != nil {
-		res, ok := tryGet(m)
+		res, ok := m.tryGet(key)
 		if ok {
-			return res, true
+			return res.(V), true
 		}
 		// The previousContext member is never mutated, so it's safe to read it outside
 		// the locked area.
@@ -105,6 +104,23 @@ func TryGetMutableContextValue[V any](ctx context.Context, key MutableContextKey
 	return none, false
 }
 
+// GetAllMutableContextValues returns the values from all the forked mutable contexts,
+// starting from the outermost one. It can be used to merge the inherited values.
+func GetAllMutableContextValues[V any](ctx context.Context, key MutableContextKey[V]) []V {
+	var res []V
+	for m := tryGetMutableContext(ctx); m != nil; m = m.previousContext {
+		if val, ok := m.tryGet(key); ok {
+			res = append(res, val.(V))
+		}
+	}
+
+	// Reverse the order, so that the outermost value comes first
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
 func MustGetMutableContextValue[V any](ctx context.Context, key MutableContextKey[V]) V {
 	res, ok := TryGetMutableContextValue(ctx, key)
 	PanicIfF(!ok, "failed to find the value")
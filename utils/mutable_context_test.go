@@ -17,6 +17,9 @@ func TestMutableContext(t *testing.T) {
 	assert.Panics(t, func() {
 		mustGetMutableContext(root)
 	})
+	_, ok := TryGetMutableContextValue(root, SomeMutableString)
+	assert.False(t, ok)
+	assert.Empty(t, GetAllMutableContextValues(root, SomeMutableString))
 
 	root = ForkMutableContext(root)
 	child := ForkMutableContext(root)
@@ -34,6 +37,9 @@ func TestMutableContext(t *testing.T) {
 	s = MustGetMutableContextValue(root, SomeMutableString)
 	assert.Equal(t, "root", s)
 
+	assert.Equal(t, []string{"root", "child"}, GetAllMutableContextValues(child, SomeMutableString))
+	assert.Equal(t, []string{"anotherRoot"}, GetAllMutableContextValues(child, AnotherMutableString))
+
 	EditMutableContextValue(root, SomeMutableString, func(value string, present bool) (string, bool) {
 		assert.Equal(t, "root", value)
 		assert.True(t, present)
@@ -0,0 +1,203 @@
+package visibility
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogField selects a group of fields in the access log lines
+type AccessLogField string
+
+const (
+	AccessLogMethod    AccessLogField = "method"
+	AccessLogRoute     AccessLogField = "route"
+	AccessLogStatus    AccessLogField = "status"
+	AccessLogLatency   AccessLogField = "latency"
+	AccessLogBytes     AccessLogField = "bytes"
+	AccessLogClientIP  AccessLogField = "client_ip"
+	AccessLogUserAgent AccessLogField = "user_agent"
+	AccessLogRequestID AccessLogField = "request_id"
+	// AccessLogTrace adds the fields produced by Observer.LogFieldsForSpan
+	AccessLogTrace AccessLogField = "trace"
+	// AccessLogMetrics adds the values accumulated in the request's MetricHelper
+	AccessLogMetrics AccessLogField = "metrics"
+)
+
+// DefaultAccessLogFields are logged if no fields are configured
+var DefaultAccessLogFields = []AccessLogField{AccessLogMethod, AccessLogRoute, AccessLogStatus,
+	AccessLogLatency, AccessLogBytes, AccessLogClientIP, AccessLogUserAgent, AccessLogRequestID,
+	AccessLogTrace, AccessLogMetrics}
+
+// AccessLogConfig is the configuration of the AccessLogger
+type AccessLogConfig struct {
+	// The logger for the access log, the Observer's logger named "access" by default
+	Logger *zap.Logger
+
+	// The logged fields, DefaultAccessLogFields if empty
+	Fields []AccessLogField
+
+	// The ratio of the successful requests to log, 1 by default. The failed requests
+	// are always logged.
+	SuccessSampleRatio float64
+
+	// Take the client IP from the X-Forwarded-For header, only enable it if the
+	// service is behind a trusted proxy
+	TrustForwardedFor bool
+}
+
+// AccessLogOption is used to customize the AccessLogger
+type AccessLogOption func(cfg *AccessLogConfig)
+
+// WithAccessLogLogger overrides the logger for the access log
+func WithAccessLogLogger(logger *zap.Logger) AccessLogOption {
+	return func(cfg *AccessLogConfig) {
+		cfg.Logger = logger
+	}
+}
+
+// WithAccessLogFields sets the logged fields
+func WithAccessLogFields(fields ...AccessLogField) AccessLogOption {
+	return func(cfg *AccessLogConfig) {
+		cfg.Fields = fields
+	}
+}
+
+// WithSuccessSampling only logs the specified ratio of the successful requests
+func WithSuccessSampling(ratio float64) AccessLogOption {
+	return func(cfg *AccessLogConfig) {
+		cfg.SuccessSampleRatio = ratio
+	}
+}
+
+// WithTrustedForwardedFor takes the client IP from the X-Forwarded-For header
+func WithTrustedForwardedFor() AccessLogOption {
+	return func(cfg *AccessLogConfig) {
+		cfg.TrustForwardedFor = true
+	}
+}
+
+// AccessLogEntry describes a finished request
+type AccessLogEntry struct {
+	Method    string
+	Route     string
+	Status    int
+	Latency   time.Duration
+	Bytes     int64
+	ClientIP  string
+	UserAgent string
+
+	// The request has failed without a status (e.g. the handler has panicked)
+	Failed bool
+}
+
+// AccessLogger writes a single structured line per request, correlated with the request span
+type AccessLogger struct {
+	obs    *Observer
+	cfg    AccessLogConfig
+	fields map[AccessLogField]bool
+
+	rndMtx sync.Mutex
+	rnd    *rand.Rand
+}
+
+// NewAccessLogger creates the access logger, use WithAccessLog to add it to the HTTP middleware
+func NewAccessLogger(obs *Observer, options ...AccessLogOption) *AccessLogger {
+	cfg := AccessLogConfig{
+		SuccessSampleRatio: 1,
+	}
+	for _, o := range options {
+		o(&cfg)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = obs.Logger.Named("access")
+	}
+	if len(cfg.Fields) == 0 {
+		cfg.Fields = DefaultAccessLogFields
+	}
+
+	res := &AccessLogger{
+		obs:    obs,
+		cfg:    cfg,
+		fields: make(map[AccessLogField]bool),
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, f := range cfg.Fields {
+		res.fields[f] = true
+	}
+	return res
+}
+
+func (a *AccessLogger) sampled(entry *AccessLogEntry) bool {
+	if entry.Failed || entry.Status >= 400 || a.cfg.SuccessSampleRatio >= 1 {
+		return true
+	}
+	a.rndMtx.Lock()
+	defer a.rndMtx.Unlock()
+	return a.rnd.Float64() < a.cfg.SuccessSampleRatio
+}
+
+// Log writes the access log line for the request, the span is used for the trace fields
+func (a *AccessLogger) Log(ctx context.Context, sp trace.Span, entry AccessLogEntry) {
+	if !a.sampled(&entry) {
+		return
+	}
+
+	fields := make([]zap.Field, 0, 16)
+	if a.fields[AccessLogMethod] {
+		fields = append(fields, zap.String("method", entry.Method))
+	}
+	if a.fields[AccessLogRoute] {
+		fields = append(fields, zap.String("route", entry.Route))
+	}
+	if a.fields[AccessLogStatus] {
+		fields = append(fields, zap.Int("status", entry.Status))
+	}
+	if a.fields[AccessLogLatency] {
+		fields = append(fields, zap.Duration("latency", entry.Latency))
+	}
+	if a.fields[AccessLogBytes] {
+		fields = append(fields, zap.Int64("bytes", entry.Bytes))
+	}
+	if a.fields[AccessLogClientIP] {
+		fields = append(fields, zap.String("client_ip", entry.ClientIP))
+	}
+	if a.fields[AccessLogUserAgent] {
+		fields = append(fields, zap.String("user_agent", entry.UserAgent))
+	}
+	if a.fields[AccessLogRequestID] {
+		fields = append(fields, zap.String(RequestIDAttributeName, RequestIDFromContext(ctx)))
+	}
+	if a.fields[AccessLogTrace] && a.obs.LogFieldsForSpan != nil && sp != nil {
+		fields = append(fields, a.obs.LogFieldsForSpan(sp)...)
+	}
+	if mh := TryGetMetricHelperFromContext(ctx); a.fields[AccessLogMetrics] && mh != nil {
+		fields = append(fields, zap.Any("metrics", mh.Snapshot()))
+	}
+
+	if entry.Failed || entry.Status >= 500 {
+		a.cfg.Logger.Warn("Request", fields...)
+	} else {
+		a.cfg.Logger.Info("Request", fields...)
+	}
+}
+
+func (a *AccessLogger) clientIP(r *http.Request) string {
+	if a.cfg.TrustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,66 @@
+package visibility
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, _ := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	handler := NewHTTPMiddleware(obs, WithAccessLog(NewAccessLogger(obs)))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			GetMetricHelperFromContext(r.Context()).AddCount("Items", 3)
+			_, _ = w.Write([]byte("hello"))
+		}))
+
+	req := httptest.NewRequest(http.MethodGet, "/items", nil)
+	req.Header.Set(RequestIDHeader, "req-7")
+	req.Header.Set("User-Agent", "tester/1.0")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	line := lines[0]
+	for _, expected := range []string{`"logger":"access"`, `"msg":"Request"`, `"method":"GET"`,
+		`"route":"HTTP GET"`, `"status":200`, `"bytes":5`, `"client_ip":"192.0.2.1"`,
+		`"user_agent":"tester/1.0"`, `"request_id":"req-7"`, `"dd.trace_id":`, `"Items":3`,
+		`"HTTPServerDuration":`} {
+		assert.True(t, strings.Contains(line, expected), expected)
+	}
+}
+
+func TestAccessLogOptions(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, _ := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	accessLog := NewAccessLogger(obs, WithAccessLogFields(AccessLogStatus, AccessLogClientIP),
+		WithSuccessSampling(0), WithTrustedForwardedFor())
+	handler := NewHTTPMiddleware(obs, WithAccessLog(accessLog))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/missing" {
+				http.NotFound(w, r)
+			}
+		}))
+
+	// The successful requests are not sampled
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Empty(t, sink.String())
+
+	// The failed requests are always logged
+	req := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.5, 10.0.0.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := sink.String()
+	assert.True(t, strings.Contains(line, `"status":404,"client_ip":"203.0.113.5"`))
+	assert.False(t, strings.Contains(line, `"method"`))
+}
@@ -0,0 +1,251 @@
+package visibility
+
+import (
+	"encoding/json"
+	"fmt"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SwitchableSampler is a trace sampler that can be replaced at runtime
+type SwitchableSampler struct {
+	mtx     sync.RWMutex
+	sampler sdktrace.Sampler
+	ratio   *float64 // nil if the sampler is not ratio-based
+}
+
+var _ sdktrace.Sampler = &SwitchableSampler{}
+
+// NewSwitchableSampler creates the sampler that delegates to the initial one,
+// all the traces are sampled if it's nil
+func NewSwitchableSampler(initial sdktrace.Sampler) *SwitchableSampler {
+	if initial == nil {
+		initial = sdktrace.AlwaysSample()
+	}
+	return &SwitchableSampler{sampler: initial}
+}
+
+func (s *SwitchableSampler) ShouldSample(parameters sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.sampler.ShouldSample(parameters)
+}
+
+func (s *SwitchableSampler) Description() string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.sampler.Description()
+}
+
+// Ratio returns the current sampling ratio, the second value is false if the sampler
+// has not been set through SetRatio
+func (s *SwitchableSampler) Ratio() (float64, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.ratio == nil {
+		return 0, false
+	}
+	return *s.ratio, true
+}
+
+// SetRatio replaces the sampler with ParentBased(TraceIDRatioBased(ratio)), the traces
+// that are already sampled upstream keep being sampled
+func (s *SwitchableSampler) SetRatio(ratio float64) error {
+	if ratio < 0 || ratio > 1 {
+		return fmt.Errorf("sampling ratio must be within [0, 1], got %v", ratio)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))
+	s.ratio = &ratio
+	return nil
+}
+
+// AdminHandler returns the handler to inspect and change the telemetry settings at runtime.
+// All the endpoints accept and return JSON:
+//
+//	GET  /log-level                     {"level":"info","loggers":{"db":"debug"}}
+//	PUT  /log-level                     {"level":"debug"} or {"logger":"db","level":"debug"}
+//	DELETE /log-level?logger=db         makes "db" use the global level again
+//	GET  /sampling                      {"ratio":0.1,"description":"ParentBased{...}"}
+//	PUT  /sampling                      {"ratio":0.5}
+//	GET  /slow-span-threshold           {"threshold":"1s"}
+//	PUT  /slow-span-threshold           {"threshold":"250ms"}, "0s" turns off the slow span logging
+//	GET  /metric-cardinality            {"metrics":{"HTTPServerSuccess":12}}
+//
+// Use http.StripPrefix to mount it under a different path. The handler has no authentication,
+// so it must not be exposed to the outside world.
+func (o *Observer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/log-level", o.handleLogLevel)
+	mux.HandleFunc("/sampling", o.handleSampling)
+	mux.HandleFunc("/slow-span-threshold", o.handleSlowSpanThreshold)
+	mux.HandleFunc("/metric-cardinality", o.handleMetricCardinality)
+	return mux
+}
+
+type logLevelState struct {
+	Level   string            `json:"level"`
+	Loggers map[string]string `json:"loggers"`
+}
+
+type logLevelRequest struct {
+	Logger string `json:"logger"`
+	Level  string `json:"level"`
+}
+
+func (o *Observer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if o.LogLevels == nil {
+		writeAdminError(w, http.StatusNotImplemented, "the log level control is not enabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		req := logLevelRequest{}
+		if !readAdminRequest(w, r, &req) {
+			return
+		}
+		var lvl zapcore.Level
+		if err := lvl.UnmarshalText([]byte(req.Level)); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Logger == "" {
+			o.LogLevels.SetLevel(lvl)
+		} else {
+			o.LogLevels.SetLoggerLevel(req.Logger, lvl)
+		}
+	case http.MethodDelete:
+		name := r.URL.Query().Get("logger")
+		if name == "" {
+			writeAdminError(w, http.StatusBadRequest, "the logger name is required")
+			return
+		}
+		o.LogLevels.ResetLoggerLevel(name)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "unsupported method: "+r.Method)
+		return
+	}
+
+	state := logLevelState{Level: o.LogLevels.Level().String(), Loggers: map[string]string{}}
+	for k, v := range o.LogLevels.LoggerLevels() {
+		state.Loggers[k] = v.String()
+	}
+	writeAdminResponse(w, state)
+}
+
+type samplingState struct {
+	Ratio       *float64 `json:"ratio"`
+	Description string   `json:"description,omitempty"`
+}
+
+func (o *Observer) handleSampling(w http.ResponseWriter, r *http.Request) {
+	if o.Sampler == nil {
+		writeAdminError(w, http.StatusNotImplemented, "the tracing is not enabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		req := samplingState{}
+		if !readAdminRequest(w, r, &req) {
+			return
+		}
+		if req.Ratio == nil {
+			writeAdminError(w, http.StatusBadRequest, "the ratio is required")
+			return
+		}
+		if err := o.Sampler.SetRatio(*req.Ratio); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "unsupported method: "+r.Method)
+		return
+	}
+
+	state := samplingState{Description: o.Sampler.Description()}
+	if ratio, ok := o.Sampler.Ratio(); ok {
+		state.Ratio = &ratio
+	}
+	writeAdminResponse(w, state)
+}
+
+type slowSpanState struct {
+	Threshold string `json:"threshold"`
+}
+
+func (o *Observer) handleSlowSpanThreshold(w http.ResponseWriter, r *http.Request) {
+	if o.SlowSpanThreshold == nil {
+		writeAdminError(w, http.StatusNotImplemented, "the slow span logging is not enabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		req := slowSpanState{}
+		if !readAdminRequest(w, r, &req) {
+			return
+		}
+		threshold, err := time.ParseDuration(req.Threshold)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if threshold < 0 {
+			writeAdminError(w, http.StatusBadRequest, "the threshold must not be negative")
+			return
+		}
+		o.SlowSpanThreshold.Store(threshold)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "unsupported method: "+r.Method)
+		return
+	}
+
+	writeAdminResponse(w, slowSpanState{Threshold: o.SlowSpanThreshold.Load().String()})
+}
+
+type cardinalityState struct {
+	Metrics map[string]int `json:"metrics"`
+}
+
+func (o *Observer) handleMetricCardinality(w http.ResponseWriter, r *http.Request) {
+	if o.Cardinality == nil {
+		writeAdminError(w, http.StatusNotImplemented, "the metric cardinality is not tracked")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "unsupported method: "+r.Method)
+		return
+	}
+	writeAdminResponse(w, cardinalityState{Metrics: o.Cardinality.Cardinalities()})
+}
+
+func readAdminRequest(w http.ResponseWriter, r *http.Request, req any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeAdminResponse(w http.ResponseWriter, resp any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,129 @@
+package visibility
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminCall(h http.Handler, method, path, body string) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, strings.TrimSpace(rec.Body.String())
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, _ := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+	h := obs.AdminHandler()
+
+	code, body := adminCall(h, http.MethodGet, "/log-level", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"level":"debug","loggers":{}}`, body)
+
+	code, body = adminCall(h, http.MethodPut, "/log-level", `{"level":"warn"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"level":"warn","loggers":{}}`, body)
+
+	code, body = adminCall(h, http.MethodPut, "/log-level", `{"logger":"Billing","level":"debug"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"level":"warn","loggers":{"Billing":"debug"}}`, body)
+
+	// The loggers created by ContextWithLogger are controlled too
+	logging.L(obs.ContextWithLogger(context.Background(), "Billing")).Debug("billing")
+	logging.L(obs.ContextWithLogger(context.Background(), "Shipping")).Info("shipping")
+	assert.Equal(t, `{"level":"debug","logger":"Billing","msg":"billing"}`, strings.TrimSpace(sink.String()))
+
+	code, body = adminCall(h, http.MethodDelete, "/log-level?logger=Billing", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"level":"warn","loggers":{}}`, body)
+	assert.Equal(t, zapcore.WarnLevel, obs.LogLevels.LevelFor("Billing"))
+
+	code, body = adminCall(h, http.MethodPut, "/log-level", `{"level":"loud"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, `{"error":"unrecognized level: \"loud\""}`, body)
+
+	code, _ = adminCall(h, http.MethodPost, "/log-level", `{}`)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestAdminSampling(t *testing.T) {
+	_, logger := logging.NewMemorySinkLogger()
+	obs, rec := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+	h := obs.AdminHandler()
+
+	code, body := adminCall(h, http.MethodGet, "/sampling", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"ratio":null,"description":"AlwaysOnSampler"}`, body)
+
+	code, body = adminCall(h, http.MethodPut, "/sampling", `{"ratio":0}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, strings.HasPrefix(body, `{"ratio":0,"description":"ParentBased{root:TraceIDRatioBased{0}`))
+
+	sp, _ := BeginNewSpan(context.Background(), obs, "NotSampled")
+	CleanupSpan(sp)
+	assert.Empty(t, rec.Get().Spans)
+
+	code, body = adminCall(h, http.MethodPut, "/sampling", `{"ratio":2}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, `{"error":"sampling ratio must be within [0, 1], got 2"}`, body)
+
+	code, _ = adminCall(h, http.MethodPut, "/sampling", `{"rate":1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestSwitchableSamplerDefault(t *testing.T) {
+	sampler := NewSwitchableSampler(nil)
+	assert.Equal(t, "AlwaysOnSampler", sampler.Description())
+	assert.Equal(t, sdktrace.RecordAndSample,
+		sampler.ShouldSample(sdktrace.SamplingParameters{}).Decision)
+}
+
+func TestAdminSlowSpanThreshold(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, _ := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+	h := obs.AdminHandler()
+
+	code, body := adminCall(h, http.MethodGet, "/slow-span-threshold", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"threshold":"0s"}`, body)
+
+	sp, _ := BeginNewSpan(context.Background(), obs, "FastSpan")
+	CleanupSpan(sp)
+	assert.Empty(t, sink.String())
+
+	code, body = adminCall(h, http.MethodPut, "/slow-span-threshold", `{"threshold":"1ms"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"threshold":"1ms"}`, body)
+
+	sp, _ = BeginNewSpan(context.Background(), obs, "SlowSpan")
+	time.Sleep(5 * time.Millisecond)
+	CleanupSpan(sp)
+	assert.True(t, strings.Contains(sink.String(), `"logger":"SlowSpan","msg":"Slow span"`))
+
+	code, _ = adminCall(h, http.MethodPut, "/slow-span-threshold", `{"threshold":"-1s"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAdminWithoutTracing(t *testing.T) {
+	_, logger := logging.NewMemorySinkLogger()
+	obs, err := NewObserver(logger, NewBlindObserverOptions())
+	assert.NoError(t, err)
+	defer obs.Shutdown(context.Background())
+
+	code, _ := adminCall(obs.AdminHandler(), http.MethodGet, "/sampling", "")
+	assert.Equal(t, http.StatusNotImplemented, code)
+	code, _ = adminCall(obs.AdminHandler(), http.MethodGet, "/log-level", "")
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -22,7 +22,8 @@ func IsCanaryRequest(ctx context.Context) bool {
 func MarkAsCanary(ctx context.Context, isCanary bool) context.Context {
     mem, err := baggage.NewMember(CanaryBaggageKey, strconv.FormatBool(isCanary))
     utils.PanicIfErr(err)
-    bg, err := baggage.New(mem)
+    // Keep the other baggage members, e.g. the request ID
+    bg, err := baggage.FromContext(ctx).SetMember(mem)
     utils.PanicIfErr(err)
     return baggage.ContextWithBaggage(ctx, bg)
 }
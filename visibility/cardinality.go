@@ -0,0 +1,187 @@
+package visibility
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// OverflowAttribute marks the series that collects the measurements over the cardinality limits
+var OverflowAttribute = attribute.Bool("otel.metric.overflow", true)
+
+var overflowSet = attribute.NewSet(OverflowAttribute)
+
+// The warnings about the exceeded limits are logged at most once per this interval for each metric
+const cardinalityWarningInterval = time.Minute
+
+// CardinalityLimits limit the number of the distinct attribute sets (series) of the metrics
+// submitted through the MetricHelper. The zero values mean "unlimited".
+type CardinalityLimits struct {
+	// The default limit for each metric
+	PerMetric int `json:"per_metric" yaml:"per_metric"`
+	// The limits for the specific metrics (with the prefix), they override PerMetric
+	Metrics map[string]int `json:"metrics" yaml:"metrics"`
+	// The limit for all the metrics together
+	Total int `json:"total" yaml:"total"`
+}
+
+// Validate checks that the limits are not negative
+func (c CardinalityLimits) Validate() error {
+	if c.PerMetric < 0 || c.Total < 0 {
+		return fmt.Errorf("the cardinality limits must not be negative")
+	}
+	for name, limit := range c.Metrics {
+		if limit < 0 {
+			return fmt.Errorf("the cardinality limit for %s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// IsUnlimited checks if no limits are set, there's no point in tracking the series then
+func (c CardinalityLimits) IsUnlimited() bool {
+	if c.PerMetric != 0 || c.Total != 0 {
+		return false
+	}
+	for _, limit := range c.Metrics {
+		if limit != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// CardinalityLimiter tracks the attribute sets of each metric, and collapses the new sets
+// over the limits into the overflow series with the OverflowAttribute (and the attributes
+// added by the Observer, so that e.g. the canary requests stay apart). The series
+// that were seen before keep their attributes. A warning with the attribute key that has
+// the most distinct values is logged when a metric overflows.
+type CardinalityLimiter struct {
+	limits CardinalityLimits
+	logger *zap.Logger
+
+	mtx          sync.Mutex
+	series       map[string]*metricSeries
+	total        int
+	lastWarnings map[string]time.Time
+}
+
+type metricSeries struct {
+	sets map[attribute.Distinct]struct{}
+	// The distinct values of each attribute key, to find the offending key
+	values map[attribute.Key]map[string]struct{}
+}
+
+// NewCardinalityLimiter creates the limiter, it's shared by all the MetricHelpers of the Observer
+func NewCardinalityLimiter(logger *zap.Logger, limits CardinalityLimits) *CardinalityLimiter {
+	return &CardinalityLimiter{
+		limits:       limits,
+		logger:       logger,
+		series:       make(map[string]*metricSeries),
+		lastWarnings: make(map[string]time.Time),
+	}
+}
+
+// Limit returns the attribute set to use for the measurement of the metric: either
+// the original set, or the overflow set if the limits are exceeded. The overflow set
+// also has the kept attributes (e.g. the Observer's MetricAttributes and the canary flag).
+func (l *CardinalityLimiter) Limit(metric string, set attribute.Set, keep ...attribute.KeyValue) attribute.Set {
+	if l == nil {
+		return set
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	s := l.series[metric]
+	if s == nil {
+		s = &metricSeries{
+			sets:   make(map[attribute.Distinct]struct{}),
+			values: make(map[attribute.Key]map[string]struct{}),
+		}
+		l.series[metric] = s
+	}
+	if _, ok := s.sets[set.Equivalent()]; ok {
+		return set
+	}
+
+	limit, ok := l.limits.Metrics[metric]
+	if !ok {
+		limit = l.limits.PerMetric
+	}
+	if limit > 0 && len(s.sets) >= limit {
+		l.warn(metric, s, set, fmt.Sprintf("the limit of %d series for the metric", limit))
+		return overflowAttributeSet(keep)
+	}
+	if l.limits.Total > 0 && l.total >= l.limits.Total {
+		l.warn(metric, s, set, fmt.Sprintf("the total limit of %d series", l.limits.Total))
+		return overflowAttributeSet(keep)
+	}
+
+	s.sets[set.Equivalent()] = struct{}{}
+	l.total++
+	for iter := set.Iter(); iter.Next(); {
+		kv := iter.Attribute()
+		values := s.values[kv.Key]
+		if values == nil {
+			values = make(map[string]struct{})
+			s.values[kv.Key] = values
+		}
+		values[kv.Value.Emit()] = struct{}{}
+	}
+	return set
+}
+
+func overflowAttributeSet(keep []attribute.KeyValue) attribute.Set {
+	if len(keep) == 0 {
+		return overflowSet
+	}
+	return attribute.NewSet(appendAttrs(keep, []attribute.KeyValue{OverflowAttribute})...)
+}
+
+func (l *CardinalityLimiter) warn(metric string, s *metricSeries, rejected attribute.Set, reason string) {
+	now := time.Now()
+	if last, ok := l.lastWarnings[metric]; ok && now.Sub(last) < cardinalityWarningInterval {
+		return
+	}
+	l.lastWarnings[metric] = now
+
+	// The key with the most distinct values is the most likely culprit
+	var offending attribute.Key
+	maxValues := -1
+	for iter := rejected.Iter(); iter.Next(); {
+		key := iter.Attribute().Key
+		if n := len(s.values[key]); n > maxValues {
+			offending, maxValues = key, n
+		}
+	}
+
+	l.logger.Warn("Metric cardinality limit exceeded, the new series are collapsed into the overflow series",
+		zap.String("metric", metric), zap.String("reason", reason),
+		zap.String("key", string(offending)), zap.Int("distinct_values", maxValues))
+}
+
+// Cardinality returns the number of the series of the metric, excluding the overflow series
+func (l *CardinalityLimiter) Cardinality(metric string) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if s := l.series[metric]; s != nil {
+		return len(s.sets)
+	}
+	return 0
+}
+
+// Cardinalities returns the number of the series of all the metrics
+func (l *CardinalityLimiter) Cardinalities() map[string]int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	res := make(map[string]int, len(l.series))
+	for name, s := range l.series {
+		res[name] = len(s.sets)
+	}
+	return res
+}
@@ -0,0 +1,146 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func collectSumSets(t *testing.T, reader sdkmetric.Reader, name string) map[attribute.Distinct]float64 {
+	rm := metricdata.ResourceMetrics{}
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	res := map[attribute.Distinct]float64{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		if m.Name != name {
+			continue
+		}
+		for _, p := range m.Data.(metricdata.Sum[float64]).DataPoints {
+			res[p.Attributes.Equivalent()] = p.Value
+		}
+	}
+	return res
+}
+
+func TestCardinalityLimits(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, _ := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	obs.Cardinality = NewCardinalityLimiter(logger, CardinalityLimits{
+		PerMetric: 2,
+		Metrics:   map[string]int{"Unlimited": 100},
+	})
+
+	for i := 0; i < 5; i++ {
+		mh := obs.MakeMetricHelper(context.Background())
+		mh.SetTag("user", fmt.Sprintf("user-%d", i))
+		mh.SetTag("region", "eu")
+		mh.AddCount("Requests", 1)
+		mh.AddCount("Unlimited", 1)
+	}
+	// The known series are still accepted after the overflow
+	mh := obs.MakeMetricHelper(context.Background())
+	mh.SetTag("user", "user-0")
+	mh.SetTag("region", "eu")
+	mh.AddCount("Requests", 10)
+
+	sets := collectSumSets(t, reader, "Requests")
+	assert.Equal(t, 3, len(sets))
+	user0 := attribute.NewSet(attribute.String("user", "user-0"), attribute.String("region", "eu"))
+	assert.Equal(t, 11.0, sets[user0.Equivalent()])
+	assert.Equal(t, 3.0, sets[overflowSet.Equivalent()])
+	// The overflow series gets the sample count too
+	assert.Equal(t, 3.0, collectSumSets(t, reader, "Requests_num")[overflowSet.Equivalent()])
+
+	assert.Equal(t, 5, len(collectSumSets(t, reader, "Unlimited")))
+	assert.Equal(t, 2, obs.Cardinality.Cardinality("Requests"))
+	assert.Equal(t, 0, obs.Cardinality.Cardinality("Missing"))
+	assert.Equal(t, map[string]int{"Requests": 2, "Unlimited": 5}, obs.Cardinality.Cardinalities())
+
+	// The warning is rate-limited and names the key with the most distinct values
+	log := sink.String()
+	assert.Equal(t, 1, strings.Count(log, `"metric":"Requests",`))
+	assert.True(t, strings.Contains(log, `"key":"user","distinct_values":2`))
+}
+
+func TestCardinalityOverflowKeepsObserverAttributes(t *testing.T) {
+	_, logger := logging.NewMemorySinkLogger()
+	obs, _ := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	obs.MetricAttributes = []attribute.KeyValue{attribute.String("service", "storage")}
+	obs.Cardinality = NewCardinalityLimiter(logger, CardinalityLimits{PerMetric: 1})
+
+	ctx := MarkAsCanary(context.Background(), true)
+	for i := 0; i < 3; i++ {
+		mh := obs.MakeMetricHelper(ctx)
+		mh.SetTag("user", fmt.Sprintf("user-%d", i))
+		mh.AddCount("Requests", 1)
+	}
+
+	// The canary requests can still be told apart from the real traffic
+	overflow := attribute.NewSet(attribute.String("service", "storage"),
+		attribute.Bool(CanaryAttributeName, true), OverflowAttribute)
+	sets := collectSumSets(t, reader, "Requests")
+	assert.Equal(t, 2, len(sets))
+	assert.Equal(t, 2.0, sets[overflow.Equivalent()])
+}
+
+func TestCardinalityTotalLimit(t *testing.T) {
+	_, logger := logging.NewMemorySinkLogger()
+	limiter := NewCardinalityLimiter(logger, CardinalityLimits{Total: 3})
+
+	a := attribute.NewSet(attribute.String("k", "a"))
+	b := attribute.NewSet(attribute.String("k", "b"))
+	assert.Equal(t, a, limiter.Limit("One", a))
+	assert.Equal(t, b, limiter.Limit("One", b))
+	assert.Equal(t, a, limiter.Limit("Two", a))
+	assert.Equal(t, overflowSet, limiter.Limit("Two", b))
+	assert.Equal(t, overflowSet, limiter.Limit("Three", a))
+	assert.Equal(t, a, limiter.Limit("Two", a))
+
+	// The nil limiter doesn't limit anything
+	var none *CardinalityLimiter
+	assert.Equal(t, b, none.Limit("One", b))
+
+	assert.Error(t, CardinalityLimits{PerMetric: -1}.Validate())
+	assert.Error(t, CardinalityLimits{Metrics: map[string]int{"A": -1}}.Validate())
+	assert.NoError(t, CardinalityLimits{PerMetric: 10, Total: 100}.Validate())
+
+	assert.True(t, CardinalityLimits{}.IsUnlimited())
+	assert.True(t, CardinalityLimits{Metrics: map[string]int{"A": 0}}.IsUnlimited())
+	assert.False(t, CardinalityLimits{Metrics: map[string]int{"A": 1}}.IsUnlimited())
+}
+
+func TestAdminMetricCardinality(t *testing.T) {
+	_, logger := logging.NewMemorySinkLogger()
+	obs, _ := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+	h := obs.AdminHandler()
+
+	// Nothing is tracked without the limits
+	code, _ := adminCall(h, http.MethodGet, "/metric-cardinality", "")
+	assert.Equal(t, http.StatusNotImplemented, code)
+
+	obs.Cardinality = NewCardinalityLimiter(logger, CardinalityLimits{PerMetric: 100})
+	mh := obs.MakeMetricHelper(context.Background())
+	mh.AddCount("Requests", 1)
+
+	code, body := adminCall(h, http.MethodGet, "/metric-cardinality", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"metrics":{"Requests":1}}`, body)
+
+	code, _ = adminCall(h, http.MethodPut, "/metric-cardinality", `{}`)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,480 @@
+package visibility
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	ConfigFormatYAML = "yaml"
+	ConfigFormatJSON = "json"
+
+	ExporterOTLP = "otlp"
+	ExporterNone = "none"
+)
+
+// ObserverConfig is the declarative configuration for the logger and the Observer. It can be
+// loaded from a YAML or JSON file using LoadObserverConfig, e.g.:
+//
+//	library_name: ArgusApp
+//	service_name: TracedDB
+//	environment: ${DEPLOYMENT_ENV:-alpha}
+//	logging:
+//	  level: info
+//	  encoding: json
+//	tracing:
+//	  endpoint: ${COLLECTOR_HOST}:4317
+//	  sampling_ratio: 0.25
+//	  exporters:
+//	    - endpoint: traces.example.com:4318
+//	      protocol: http/protobuf
+//	      use_tls: true
+//	metrics:
+//	  exporter: none
+//	resource_attributes:
+//	  team: storage
+//	leak_policy: log
+type ObserverConfig struct {
+	LibraryName string `json:"library_name" yaml:"library_name"`
+	ServiceName string `json:"service_name" yaml:"service_name"`
+	Environment string `json:"environment" yaml:"environment"`
+
+	Logging LoggingConfig `json:"logging" yaml:"logging"`
+	Tracing TracingConfig `json:"tracing" yaml:"tracing"`
+	Metrics MetricsConfig `json:"metrics" yaml:"metrics"`
+
+	// Additional attributes for the resource, they override the detected attributes
+	ResourceAttributes map[string]string `json:"resource_attributes" yaml:"resource_attributes"`
+
+	// One of: "panic" (the default), "log" or "ignore"
+	LeakPolicy string `json:"leak_policy" yaml:"leak_policy"`
+
+	RuntimeMetrics bool `json:"runtime_metrics" yaml:"runtime_metrics"`
+
+	// Don't log the OTel errors through the Observer's logger, see ObserverOptions.KeepErrorHandler
+	KeepErrorHandler bool `json:"keep_error_handler" yaml:"keep_error_handler"`
+}
+
+type LoggingConfig struct {
+	// One of the zap levels: "debug", "info" (the default), "warn", "error", "dpanic", "panic", "fatal"
+	Level string `json:"level" yaml:"level"`
+	// One of: "json" (the default), "console" or "prettyconsole"
+	Encoding string `json:"encoding" yaml:"encoding"`
+	// Use the zap development defaults (stacktraces for warnings, DPanic panics)
+	Development bool `json:"development" yaml:"development"`
+}
+
+type TracingConfig struct {
+	// Either "otlp" (the default) or "none"
+	Exporter string `json:"exporter" yaml:"exporter"`
+	// The OTLP gRPC endpoint, OTEL_EXPORTER_OTLP_TRACES_ENDPOINT and OTEL_EXPORTER_OTLP_ENDPOINT
+	// are used if it's empty
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// The ratio of the root traces to sample, the sampling decision of the parent is respected
+	// for the child spans. All the traces are sampled if it's not set.
+	SamplingRatio *float64 `json:"sampling_ratio" yaml:"sampling_ratio"`
+	// Additional backends for the traces, they are used in addition to the endpoint. They
+	// can't be used with the "none" exporter.
+	Exporters []ExporterConfig `json:"exporters" yaml:"exporters"`
+}
+
+type MetricsConfig struct {
+	// Either "otlp" (the default) or "none"
+	Exporter string `json:"exporter" yaml:"exporter"`
+	// The OTLP gRPC endpoint, OTEL_EXPORTER_OTLP_METRICS_ENDPOINT and OTEL_EXPORTER_OTLP_ENDPOINT
+	// are used if it's empty
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// The bucket boundaries for the histograms, by the metric name
+	HistogramBuckets HistogramBuckets `json:"histogram_buckets" yaml:"histogram_buckets"`
+	// The limits for the number of the distinct attribute sets of the metrics
+	Cardinality CardinalityLimits `json:"cardinality" yaml:"cardinality"`
+	// Accumulate the values in the MetricHelpers and submit them once per request
+	PreAggregate bool `json:"pre_aggregate" yaml:"pre_aggregate"`
+	// Submit the values in the base units (e.g. "s" and "By"), the histogram buckets have
+	// to use the base units too
+	NormalizeUnits bool `json:"normalize_units" yaml:"normalize_units"`
+	// The prefix for the metrics of the canary requests, instead of the "canary" attribute
+	CanaryPrefix string `json:"canary_prefix" yaml:"canary_prefix"`
+	// Write the metrics as the CloudWatch EMF log lines with this namespace, the logging
+	// must use the JSON encoding. Set the exporter to "none" to only use EMF.
+	EMFNamespace string `json:"emf_namespace" yaml:"emf_namespace"`
+	// Additional backends for the metrics, they are used in addition to the endpoint. They
+	// can't be used with the "none" exporter.
+	Exporters []ExporterConfig `json:"exporters" yaml:"exporters"`
+}
+
+// ExporterConfig describes an additional OTLP backend, see TraceExporterOptions
+// and MetricExporterOptions
+type ExporterConfig struct {
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// Either "grpc" (the default) or "http/protobuf"
+	Protocol string            `json:"protocol" yaml:"protocol"`
+	UseTLS   bool              `json:"use_tls" yaml:"use_tls"`
+	Headers  map[string]string `json:"headers" yaml:"headers"`
+	// Spool the spans into this directory before sending them, only supported for the traces
+	PersistentQueueDir string `json:"persistent_queue_dir" yaml:"persistent_queue_dir"`
+}
+
+// LoadObserverConfig reads the configuration file, the format is detected by the file
+// extension: ".json" files are parsed as JSON, everything else as YAML.
+func LoadObserverConfig(path string) (ObserverConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ObserverConfig{}, err
+	}
+
+	format := ConfigFormatYAML
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		format = ConfigFormatJSON
+	}
+
+	cfg, err := ParseObserverConfig(data, format)
+	if err != nil {
+		return ObserverConfig{}, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseObserverConfig parses and validates the configuration. The environment variables in the
+// form of ${VAR} or ${VAR:-default} are interpolated into the text before parsing, so they
+// can be used for the non-string values too (e.g. "sampling_ratio: ${RATIO}"). The values
+// are inserted as is, without quoting. Use $$ for a literal "$". Unknown fields are treated
+// as errors to catch typos.
+func ParseObserverConfig(data []byte, format string) (ObserverConfig, error) {
+	var cfg ObserverConfig
+	data = []byte(ExpandConfigEnv(string(data), os.LookupEnv))
+	switch format {
+	case ConfigFormatJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return ObserverConfig{}, err
+		}
+	case ConfigFormatYAML:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		// An empty document is a valid (default) configuration
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return ObserverConfig{}, err
+		}
+	default:
+		return ObserverConfig{}, fmt.Errorf("unknown config format: %s", format)
+	}
+	if err := cfg.Validate(); err != nil {
+		return ObserverConfig{}, err
+	}
+	return cfg, nil
+}
+
+// ExpandConfigEnv replaces ${VAR} and ${VAR:-default} with the values of the
+// environment variables, the lookup function is normally os.LookupEnv. The "$$" is
+// replaced by "$", the other uses of "$" (e.g. "$VAR") are left as is.
+func ExpandConfigEnv(data string, lookup func(string) (string, bool)) string {
+	if !strings.Contains(data, "$") {
+		return data
+	}
+
+	var res strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] != '$' || i+1 == len(data) {
+			res.WriteByte(data[i])
+			continue
+		}
+		if data[i+1] == '$' {
+			res.WriteByte('$')
+			i++
+			continue
+		}
+		end := strings.IndexByte(data[i+1:], '}')
+		if data[i+1] != '{' || end < 0 {
+			res.WriteByte('$')
+			continue
+		}
+
+		expr := data[i+2 : i+1+end]
+		name, def, _ := strings.Cut(expr, ":-")
+		if !isEnvName(name) {
+			res.WriteByte('$')
+			continue
+		}
+		val, ok := lookup(name)
+		if !ok || val == "" {
+			val = def
+		}
+		res.WriteString(val)
+		i += 1 + end
+	}
+	return res.String()
+}
+
+func isEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		valid := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9'
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the configuration for consistency, all the problems are reported at once
+func (c *ObserverConfig) Validate() error {
+	var problems []string
+
+	if _, err := c.zapLevel(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	switch c.Logging.Encoding {
+	case "", "json", "console", "prettyconsole":
+	default:
+		problems = append(problems, "unknown logging encoding: "+c.Logging.Encoding)
+	}
+
+	if !isValidExporter(c.Tracing.Exporter) {
+		problems = append(problems, "unknown tracing exporter: "+c.Tracing.Exporter)
+	}
+	if c.Tracing.SamplingRatio != nil && (*c.Tracing.SamplingRatio < 0 || *c.Tracing.SamplingRatio > 1) {
+		problems = append(problems, fmt.Sprintf(
+			"tracing sampling ratio must be within [0, 1], got %v", *c.Tracing.SamplingRatio))
+	}
+	if c.Tracing.Exporter == ExporterNone && len(c.Tracing.Exporters) != 0 {
+		problems = append(problems, "the tracing exporters are listed, but the tracing exporter is none")
+	}
+	for _, e := range c.Tracing.Exporters {
+		problems = append(problems, e.validate("tracing")...)
+	}
+	if !isValidExporter(c.Metrics.Exporter) {
+		problems = append(problems, "unknown metrics exporter: "+c.Metrics.Exporter)
+	}
+	if c.Metrics.Exporter == ExporterNone && len(c.Metrics.Exporters) != 0 {
+		problems = append(problems, "the metrics exporters are listed, but the metrics exporter is none")
+	}
+	for _, e := range c.Metrics.Exporters {
+		problems = append(problems, e.validate("metrics")...)
+		if e.PersistentQueueDir != "" {
+			problems = append(problems, "the persistent queue is not supported for the metrics exporters")
+		}
+	}
+	if err := c.Metrics.HistogramBuckets.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.Metrics.Cardinality.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.Metrics.EMFNamespace != "" && c.Logging.Encoding != "" && c.Logging.Encoding != "json" {
+		problems = append(problems, "the EMF metrics require the json logging encoding")
+	}
+
+	if _, err := c.leakPolicy(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for k := range c.ResourceAttributes {
+		if k == "" {
+			problems = append(problems, "empty resource attribute name")
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid observer config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func isValidExporter(exp string) bool {
+	return exp == "" || exp == ExporterOTLP || exp == ExporterNone
+}
+
+func (e *ExporterConfig) validate(signal string) []string {
+	var problems []string
+	if e.Endpoint == "" {
+		problems = append(problems, "empty "+signal+" exporter endpoint")
+	}
+	switch ExporterProtocol(e.Protocol) {
+	case "", ProtocolGRPC, ProtocolHTTP:
+	default:
+		problems = append(problems, "unknown "+signal+" exporter protocol: "+e.Protocol)
+	}
+	return problems
+}
+
+func (c *ObserverConfig) zapLevel() (zapcore.Level, error) {
+	if c.Logging.Level == "" {
+		return zapcore.InfoLevel, nil
+	}
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(c.Logging.Level)); err != nil {
+		return 0, fmt.Errorf("unknown logging level: %s", c.Logging.Level)
+	}
+	return lvl, nil
+}
+
+func (c *ObserverConfig) leakPolicy() (SpanLeakPolicy, error) {
+	switch c.LeakPolicy {
+	case "", "panic":
+		return LeakPolicyPanic, nil
+	case "log":
+		return LeakPolicyLog, nil
+	case "ignore":
+		return LeakPolicyIgnore, nil
+	}
+	return 0, fmt.Errorf("unknown leak policy: %s", c.LeakPolicy)
+}
+
+// BuildLogger creates the root zap logger from the logging configuration
+func (c *ObserverConfig) BuildLogger() (*zap.Logger, error) {
+	lvl, err := c.zapLevel()
+	if err != nil {
+		return nil, err
+	}
+
+	var config zap.Config
+	if c.Logging.Development {
+		config = zap.NewDevelopmentConfig()
+	} else {
+		config = zap.NewProductionConfig()
+	}
+	config.Level = zap.NewAtomicLevelAt(lvl)
+	if c.Metrics.EMFNamespace != "" {
+		// The sampler would drop the EMF lines, they all have the same message
+		config.Sampling = nil
+	}
+
+	switch c.Logging.Encoding {
+	case "":
+		config.Encoding = "json"
+	case "prettyconsole":
+		logging.ConfigureZapGlobals()
+		config.Encoding = c.Logging.Encoding
+		config.DisableStacktrace = true
+	default:
+		config.Encoding = c.Logging.Encoding
+	}
+
+	return config.Build(logging.MakeFieldsUnique(true))
+}
+
+// BuildObserverOptions creates the ObserverOptions, starting from NewDefaultObserverOptions
+func (c *ObserverConfig) BuildObserverOptions() (ObserverOptions, error) {
+	opts, err := NewDefaultObserverOptions(c.LibraryName, c.ServiceName, c.Environment)
+	if err != nil {
+		return ObserverOptions{}, err
+	}
+
+	if len(c.ResourceAttributes) != 0 {
+		// Sort the keys to make the resulting resource deterministic
+		keys := make([]string, 0, len(c.ResourceAttributes))
+		for k := range c.ResourceAttributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var attrs []attribute.KeyValue
+		for _, k := range keys {
+			attrs = append(attrs, attribute.String(k, c.ResourceAttributes[k]))
+		}
+		opts.Resource, err = resource.Merge(opts.Resource, resource.NewSchemaless(attrs...))
+		if err != nil {
+			return ObserverOptions{}, err
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case ExporterNone:
+		opts.TracingEndpoint = ""
+	default:
+		if c.Tracing.Endpoint != "" {
+			opts.TracingEndpoint = c.Tracing.Endpoint
+		}
+		for _, e := range c.Tracing.Exporters {
+			opts.TraceExporters = append(opts.TraceExporters, TraceExporterOptions{
+				Endpoint:           e.Endpoint,
+				Protocol:           ExporterProtocol(e.Protocol),
+				UseTLS:             e.UseTLS,
+				Headers:            e.Headers,
+				PersistentQueueDir: e.PersistentQueueDir,
+			})
+		}
+	}
+	if c.Tracing.SamplingRatio != nil {
+		// Keep the ratio visible to the AdminHandler
+		sampler := NewSwitchableSampler(nil)
+		err = sampler.SetRatio(*c.Tracing.SamplingRatio)
+		if err != nil {
+			return ObserverOptions{}, err
+		}
+		opts.Sampler = sampler
+	}
+
+	switch c.Metrics.Exporter {
+	case ExporterNone:
+		opts.MetricsEndpoint = ""
+	default:
+		if c.Metrics.Endpoint != "" {
+			opts.MetricsEndpoint = c.Metrics.Endpoint
+		}
+		for _, e := range c.Metrics.Exporters {
+			opts.MetricExporters = append(opts.MetricExporters, MetricExporterOptions{
+				Endpoint: e.Endpoint,
+				Protocol: ExporterProtocol(e.Protocol),
+				UseTLS:   e.UseTLS,
+				Headers:  e.Headers,
+			})
+		}
+	}
+
+	opts.LeakPolicy, err = c.leakPolicy()
+	if err != nil {
+		return ObserverOptions{}, err
+	}
+	opts.RuntimeMetrics = c.RuntimeMetrics
+	opts.KeepErrorHandler = c.KeepErrorHandler
+	opts.HistogramBuckets = c.Metrics.HistogramBuckets
+	opts.CardinalityLimits = c.Metrics.Cardinality
+	opts.PreAggregateMetrics = c.Metrics.PreAggregate
+	opts.NormalizeUnits = c.Metrics.NormalizeUnits
+	opts.CanaryMetricPrefix = c.Metrics.CanaryPrefix
+	opts.EMFNamespace = c.Metrics.EMFNamespace
+
+	return opts, nil
+}
+
+// NewObserverFromConfig creates both the root logger and the Observer from the configuration
+func NewObserverFromConfig(cfg ObserverConfig) (*zap.Logger, *Observer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	logger, err := cfg.BuildLogger()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts, err := cfg.BuildObserverOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obs, err := NewObserver(logger, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Return the Observer's logger, so that its levels can be changed with the AdminHandler
+	return obs.Logger, obs, nil
+}
@@ -0,0 +1,190 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"testing"
+)
+
+func TestLoadYamlConfig(t *testing.T) {
+	t.Setenv("ARGUS_TEST_COLLECTOR", "collector:4317")
+
+	cfg, err := LoadObserverConfig("testdata/observer_config.yaml")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "ArgusApp", cfg.LibraryName)
+	assert.Equal(t, "alpha", cfg.Environment) // The default value
+	assert.Equal(t, "collector:4317", cfg.Tracing.Endpoint)
+	assert.Equal(t, 0.25, *cfg.Tracing.SamplingRatio)
+	assert.Equal(t, ExporterNone, cfg.Metrics.Exporter)
+	assert.Equal(t, "$100", cfg.ResourceAttributes["cost"])
+
+	opts, err := cfg.BuildObserverOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, "collector:4317", opts.TracingEndpoint)
+	assert.Equal(t, "", opts.MetricsEndpoint)
+	assert.Equal(t, LeakPolicyLog, opts.LeakPolicy)
+	assert.Equal(t, []float64{1, 5, 25, 100}, opts.HistogramBuckets["*Latency"])
+	assert.Equal(t, CardinalityLimits{PerMetric: 1000, Total: 20000}, opts.CardinalityLimits)
+	assert.True(t, strings.HasPrefix(opts.Sampler.Description(), "ParentBased"))
+	assert.Equal(t, []TraceExporterOptions{{
+		Endpoint: "traces.example.com:4318",
+		Protocol: ProtocolHTTP,
+		UseTLS:   true,
+		Headers:  map[string]string{"api-key": "secret"},
+	}}, opts.TraceExporters)
+
+	attrs := resourceAttrs(opts.Resource)
+	assert.Equal(t, "storage", attrs["team"])
+	assert.Equal(t, "TracedDB", attrs["service.name"])
+}
+
+func TestLoadJsonConfig(t *testing.T) {
+	t.Setenv("ARGUS_TEST_COLLECTOR", "collector:4317")
+
+	cfg, err := LoadObserverConfig("testdata/observer_config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "beta", cfg.Environment)
+	assert.True(t, cfg.RuntimeMetrics)
+
+	opts, err := cfg.BuildObserverOptions()
+	assert.NoError(t, err)
+	assert.True(t, opts.KeepErrorHandler)
+	assert.Equal(t, "", opts.TracingEndpoint)
+	assert.Equal(t, "collector:4317", opts.MetricsEndpoint)
+	assert.Equal(t, []MetricExporterOptions{{Endpoint: "metrics.example.com:4318", Protocol: ProtocolHTTP}},
+		opts.MetricExporters)
+	assert.Nil(t, opts.Sampler)
+	assert.Equal(t, LeakPolicyPanic, opts.LeakPolicy)
+}
+
+func TestConfigValidation(t *testing.T) {
+	_, err := ParseObserverConfig([]byte(`{"tracing": {"endpnt": "localhost"}}`), ConfigFormatJSON)
+	assert.ErrorContains(t, err, "unknown field")
+
+	_, err = ParseObserverConfig([]byte("logging:\n  levl: debug\n"), ConfigFormatYAML)
+	assert.ErrorContains(t, err, "field levl not found")
+
+	_, err = ParseObserverConfig([]byte(`
+logging:
+  level: loud
+  encoding: xml
+tracing:
+  exporter: zipkin
+  sampling_ratio: 1.5
+leak_policy: explode
+`), ConfigFormatYAML)
+	assert.ErrorContains(t, err, "unknown logging level: loud; "+
+		"unknown logging encoding: xml; unknown tracing exporter: zipkin; "+
+		"tracing sampling ratio must be within [0, 1], got 1.5; unknown leak policy: explode")
+
+	_, err = ParseObserverConfig([]byte(`{"metrics": {"histogram_buckets": {"Lat": [5, 1]}}}`),
+		ConfigFormatJSON)
+	assert.ErrorContains(t, err, "histogram Lat: the bucket boundaries must be increasing")
+
+	_, err = ParseObserverConfig([]byte("logging:\n  encoding: console\nmetrics:\n  emf_namespace: Workers\n"),
+		ConfigFormatYAML)
+	assert.ErrorContains(t, err, "the EMF metrics require the json logging encoding")
+
+	_, err = ParseObserverConfig([]byte(`
+tracing:
+  exporters:
+    - protocol: thrift
+metrics:
+  exporters:
+    - endpoint: localhost:4318
+      persistent_queue_dir: /tmp/spool
+`), ConfigFormatYAML)
+	assert.ErrorContains(t, err, "empty tracing exporter endpoint; unknown tracing exporter protocol: thrift; "+
+		"the persistent queue is not supported for the metrics exporters")
+
+	_, err = ParseObserverConfig([]byte(`
+tracing:
+  exporter: none
+  exporters:
+    - endpoint: localhost:4317
+metrics:
+  exporter: none
+  exporters:
+    - endpoint: localhost:4318
+`), ConfigFormatYAML)
+	assert.ErrorContains(t, err, "the tracing exporters are listed, but the tracing exporter is none; "+
+		"the metrics exporters are listed, but the metrics exporter is none")
+
+	_, err = ParseObserverConfig([]byte("{}"), "toml")
+	assert.ErrorContains(t, err, "unknown config format")
+
+	// The empty config is just the defaults
+	cfg, err := ParseObserverConfig([]byte(""), ConfigFormatYAML)
+	assert.NoError(t, err)
+	assert.Equal(t, ObserverConfig{}, cfg)
+}
+
+func TestExpandConfigEnv(t *testing.T) {
+	env := map[string]string{"HOST": "collector", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	assert.Equal(t, "collector:4317", ExpandConfigEnv("${HOST}:4317", lookup))
+	assert.Equal(t, "localhost:4317", ExpandConfigEnv("${MISSING:-localhost}:4317", lookup))
+	assert.Equal(t, "def", ExpandConfigEnv("${EMPTY:-def}", lookup))
+	assert.Equal(t, "collector", ExpandConfigEnv("${HOST:-def}", lookup))
+	assert.Equal(t, "$HOST", ExpandConfigEnv("$$HOST", lookup))
+	// Only the braced names are expanded
+	assert.Equal(t, "$HOST $1 ${} ${1X} ${HOST", ExpandConfigEnv("$HOST $1 ${} ${1X} ${HOST", lookup))
+	assert.Equal(t, "collector$", ExpandConfigEnv("${HOST}$", lookup))
+}
+
+func TestConfigEnvInNonStringValues(t *testing.T) {
+	t.Setenv("ARGUS_TEST_RATIO", "0.25")
+	t.Setenv("ARGUS_TEST_RUNTIME", "true")
+
+	cfg, err := ParseObserverConfig([]byte("tracing:\n  sampling_ratio: ${ARGUS_TEST_RATIO}\n"+
+		"runtime_metrics: ${ARGUS_TEST_RUNTIME:-false}\n"), ConfigFormatYAML)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.25, *cfg.Tracing.SamplingRatio)
+	assert.True(t, cfg.RuntimeMetrics)
+
+	cfg, err = ParseObserverConfig([]byte(`{"tracing": {"sampling_ratio": ${ARGUS_TEST_RATIO}}}`),
+		ConfigFormatJSON)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.25, *cfg.Tracing.SamplingRatio)
+}
+
+func TestNewObserverFromConfig(t *testing.T) {
+	mc := runMockCollector(t)
+	t.Cleanup(mc.Stop)
+
+	cfg := ObserverConfig{
+		LibraryName: "ArgusApp",
+		ServiceName: "TracedDB",
+		Environment: "alpha",
+		Logging:     LoggingConfig{Level: "warn"},
+		Tracing:     TracingConfig{Endpoint: mc.endpoint},
+		Metrics:     MetricsConfig{Exporter: ExporterNone},
+		LeakPolicy:  "ignore",
+	}
+
+	logger, obs, err := NewObserverFromConfig(cfg)
+	assert.NoError(t, err)
+	assert.True(t, logger.Core().Enabled(zapcore.WarnLevel))
+	assert.False(t, logger.Core().Enabled(zapcore.InfoLevel))
+	assert.Same(t, logger, obs.Logger)
+	assert.Equal(t, LeakPolicyIgnore, obs.LeakPolicy)
+
+	sp, _ := BeginNewSpan(context.Background(), obs, "ConfiguredSpan")
+	// The leak checker is not armed with the "ignore" policy
+	assert.True(t, sp.(*wrappedSpan).cfg.WithoutLeakCheck)
+	CleanupSpan(sp)
+	obs.Shutdown(context.Background())
+
+	spans, _ := mc.Get()
+	assert.Equal(t, "ConfiguredSpan", spans[0].ScopeSpans[0].Spans[0].Name)
+
+	_, _, err = NewObserverFromConfig(ObserverConfig{LeakPolicy: "bad"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,209 @@
+package visibility
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The maximum number of the dimensions in a CloudWatch dimension set
+const emfMaxDimensions = 30
+
+// The keys of the log entry itself (the defaults of the zap encoders), the metrics and the
+// dimensions with these names are skipped, they would produce the duplicate JSON keys
+var emfReservedKeys = map[string]bool{
+	"_aws": true, "level": true, "ts": true, "msg": true, "logger": true,
+	"caller": true, "function": true, "stacktrace": true,
+}
+
+// The CloudWatch units and the units.go units the values are converted to for them,
+// CloudWatch has no nanoseconds, minutes or binary byte multiples
+var emfUnits = map[string]struct{ unit, convertTo string }{
+	Dimensionless:    {"Count", Dimensionless},
+	UnitNanoseconds:  {"Microseconds", UnitMicroseconds},
+	UnitMicroseconds: {"Microseconds", UnitMicroseconds},
+	UnitMilliseconds: {"Milliseconds", UnitMilliseconds},
+	UnitSeconds:      {"Seconds", UnitSeconds},
+	UnitMinutes:      {"Seconds", UnitSeconds},
+	UnitHours:        {"Seconds", UnitSeconds},
+	UnitDays:         {"Seconds", UnitSeconds},
+
+	UnitBytes:     {"Bytes", UnitBytes},
+	UnitBytesUCUM: {"Bytes", UnitBytes},
+	UnitKiloBytes: {"Kilobytes", UnitKiloBytes},
+	UnitMegaBytes: {"Megabytes", UnitMegaBytes},
+	UnitGigaBytes: {"Gigabytes", UnitGigaBytes},
+	UnitTeraBytes: {"Terabytes", UnitTeraBytes},
+	UnitKibiBytes: {"Bytes", UnitBytes},
+	UnitMebiBytes: {"Bytes", UnitBytes},
+	UnitGibiBytes: {"Bytes", UnitBytes},
+	UnitTibiBytes: {"Bytes", UnitBytes},
+
+	UnitBytesSec:         {"Bytes/Second", UnitBytesSec},
+	UnitBytesUCUM + "/s": {"Bytes/Second", UnitBytesSec},
+	UnitKiloBytesSec:     {"Kilobytes/Second", UnitKiloBytesSec},
+	UnitMegaBytesSec:     {"Megabytes/Second", UnitMegaBytesSec},
+	UnitGigaBytesSec:     {"Gigabytes/Second", UnitGigaBytesSec},
+	UnitTeraBytesSec:     {"Terabytes/Second", UnitTeraBytesSec},
+	UnitKibiBytesSec:     {"Bytes/Second", UnitBytesSec},
+	UnitMebiBytesSec:     {"Bytes/Second", UnitBytesSec},
+	UnitGibiBytesSec:     {"Bytes/Second", UnitBytesSec},
+	UnitTibiBytesSec:     {"Bytes/Second", UnitBytesSec},
+
+	UnitPercent: {"Percent", UnitPercent},
+}
+
+// EMFUnit returns the CloudWatch unit for the unit, and the value converted to it. The
+// annotations (like "{requests}") are counts, the units that CloudWatch doesn't know are "None".
+func EMFUnit(unit string, val float64) (string, float64) {
+	if isAnnotation(unit) {
+		return "Count", val
+	}
+	cw, ok := emfUnits[unit]
+	if !ok {
+		return "None", val
+	}
+	converted, err := ConvertUnit(val, unit, cw.convertTo)
+	if err != nil {
+		return "None", val
+	}
+	return cw.unit, converted
+}
+
+// EMFOption customizes the EMFSink
+type EMFOption func(s *EMFSink)
+
+// WithEMFDimensions limits the dimensions to the listed attribute keys, all the metric
+// attributes are used as the dimensions by default. Each distinct combination of the
+// dimension values is a separate CloudWatch metric, so keep them low-cardinality.
+func WithEMFDimensions(keys ...string) EMFOption {
+	return func(s *EMFSink) {
+		s.dimensions = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			s.dimensions[k] = true
+		}
+	}
+}
+
+// EMFSink writes the metrics of the closed MetricHelpers as the CloudWatch Embedded Metric
+// Format log lines, for the environments that can't run a collector (e.g. Lambda). The
+// lines are written at the info level, the logger must use the JSON encoding and must not
+// be sampled. The OTel instruments are still used, disable the metric exporters to use
+// EMF instead of them.
+//
+// The metrics and the dimensions share the top level of the line, so a dimension with
+// the same name as one of the metrics is skipped (with a warning), just like the ones
+// that clash with the keys of the log entry itself (e.g. "msg" or "level").
+//
+// Each closed MetricHelper is a separate line. Note that the operations that don't have
+// their own spans (e.g. the fast queries, see WithSlowQueryThreshold) use a helper each,
+// so they write a line per operation.
+type EMFSink struct {
+	logger     *zap.Logger
+	namespace  string
+	dimensions map[string]bool
+	// The skipped keys that have been warned about
+	skipped sync.Map
+
+	// For the tests
+	now func() time.Time
+}
+
+// NewEMFSink creates the sink, set it as the Observer's EMF to use it for all the MetricHelpers
+func NewEMFSink(logger *zap.Logger, namespace string, options ...EMFOption) *EMFSink {
+	res := &EMFSink{
+		logger:    logger,
+		namespace: namespace,
+		now:       time.Now,
+	}
+	for _, o := range options {
+		o(res)
+	}
+	return res
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+type emfDirective struct {
+	Namespace  string          `json:"Namespace"`
+	Dimensions [][]string      `json:"Dimensions"`
+	Metrics    []emfDefinition `json:"Metrics"`
+}
+
+type emfDefinition struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// Write emits a single EMF line with the metrics, nothing is written if there are none
+func (s *EMFSink) Write(metrics map[string]NamedMetric, values map[string]float64, attrs []attribute.KeyValue) {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		if emfReservedKeys[name] {
+			s.skip(name)
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+
+	// The later attributes override the earlier ones, just like in the attribute sets
+	dimValues := make(map[string]string, len(attrs))
+	for _, kv := range attrs {
+		key := string(kv.Key)
+		if s.dimensions != nil && !s.dimensions[key] {
+			continue
+		}
+		if _, isMetric := metrics[key]; isMetric || emfReservedKeys[key] {
+			s.skip(key)
+			continue
+		}
+		dimValues[key] = kv.Value.Emit()
+	}
+	dims := make([]string, 0, len(dimValues))
+	for k := range dimValues {
+		dims = append(dims, k)
+	}
+	sort.Strings(dims)
+	if len(dims) > emfMaxDimensions {
+		dims = dims[:emfMaxDimensions]
+	}
+
+	fields := make([]zap.Field, 0, len(dims)+len(names)+1)
+	for _, k := range dims {
+		fields = append(fields, zap.String(k, dimValues[k]))
+	}
+	directive := emfDirective{Namespace: s.namespace, Dimensions: [][]string{dims}}
+	for _, name := range names {
+		unit, val := EMFUnit(metrics[name].Unit, values[name])
+		// CloudWatch rejects the non-finite values
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			continue
+		}
+		directive.Metrics = append(directive.Metrics, emfDefinition{Name: name, Unit: unit})
+		fields = append(fields, zap.Float64(name, val))
+	}
+
+	fields = append(fields, zap.Any("_aws", emfMetadata{
+		Timestamp:         s.now().UnixMilli(),
+		CloudWatchMetrics: []emfDirective{directive},
+	}))
+	s.logger.Info("Metrics", fields...)
+}
+
+// skip warns about the key that can't be written, once per key
+func (s *EMFSink) skip(key string) {
+	if _, warned := s.skipped.LoadOrStore(key, true); !warned {
+		s.logger.Warn("The EMF key clashes with a metric or a log entry key, skipping it",
+			zap.String("key", key))
+	}
+}
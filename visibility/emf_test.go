@@ -0,0 +1,142 @@
+package visibility
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEMFUnits(t *testing.T) {
+	unit, val := EMFUnit(UnitNanoseconds, 1500)
+	assert.Equal(t, "Microseconds", unit)
+	assert.Equal(t, 1.5, val)
+	unit, val = EMFUnit(UnitMinutes, 2)
+	assert.Equal(t, "Seconds", unit)
+	assert.Equal(t, 120.0, val)
+	unit, val = EMFUnit(UnitKibiBytes, 2)
+	assert.Equal(t, "Bytes", unit)
+	assert.Equal(t, 2048.0, val)
+	unit, val = EMFUnit(UnitMegaBytesSec, 3)
+	assert.Equal(t, "Megabytes/Second", unit)
+	assert.Equal(t, 3.0, val)
+	unit, _ = EMFUnit("{requests}", 1)
+	assert.Equal(t, "Count", unit)
+	unit, val = EMFUnit(UnitCelsius, 36.6)
+	assert.Equal(t, "None", unit)
+	assert.Equal(t, 36.6, val)
+}
+
+func TestEMFSink(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, rec := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	// EMF can be used instead of the OTel metrics
+	obs.MeterController = noop.NewMeterProvider()
+	obs.MetricAttributes = []attribute.KeyValue{attribute.String("service", "worker")}
+	obs.EMF = NewEMFSink(logger, "Workers", WithEMFDimensions("service", "queue"))
+	obs.EMF.now = func() time.Time { return time.UnixMilli(1700000000000) }
+
+	sp, ctx := BeginNewSpan(context.Background(), obs, "Job", WithMetrics())
+	mh := GetMetricHelperFromContext(ctx)
+	mh.SetTag("queue", "high")
+	mh.SetTag("job_id", "12345")
+	mh.AddDuration("JobLatency", 1500*time.Microsecond)
+	mh.Add(Named("Payload", UnitKibiBytes), 2)
+	CleanupSpan(sp)
+	assert.Empty(t, rec.Get().Metrics)
+
+	var line map[string]interface{}
+	out := strings.TrimSpace(sink.String())
+	assert.Equal(t, 1, strings.Count(out, "\n")+1)
+	assert.NoError(t, json.Unmarshal([]byte(out), &line))
+
+	assert.Equal(t, "Metrics", line["msg"])
+	assert.Equal(t, "worker", line["service"])
+	assert.Equal(t, "high", line["queue"])
+	// Not a dimension
+	assert.Nil(t, line["job_id"])
+	assert.Equal(t, 1.5, line["JobLatency"])
+	assert.Equal(t, 2048.0, line["Payload"])
+	assert.Equal(t, 1.0, line["JobSuccess"])
+	assert.Equal(t, 0.0, line["JobFault"])
+
+	aws, err := json.Marshal(line["_aws"])
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Timestamp":1700000000000,"CloudWatchMetrics":[{"Namespace":"Workers",
+		"Dimensions":[["queue","service"]],"Metrics":[{"Name":"JobError","Unit":"Count"},
+		{"Name":"JobFault","Unit":"Count"},{"Name":"JobLatency","Unit":"Milliseconds"},
+		{"Name":"JobSuccess","Unit":"Count"},{"Name":"Payload","Unit":"Bytes"}]}]}`, string(aws))
+
+	// Nothing is written for the empty helpers
+	sink.Reset()
+	mh = obs.MakeMetricHelper(context.Background())
+	mh.Close()
+	assert.Empty(t, sink.String())
+}
+
+func TestEMFKeyClashes(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	emf := NewEMFSink(logger, "Workers")
+	emf.now = func() time.Time { return time.UnixMilli(1700000000000) }
+
+	metrics := map[string]NamedMetric{
+		"Latency": Named("Latency", UnitMilliseconds),
+		"level":   Named("level", Dimensionless),
+	}
+	values := map[string]float64{"Latency": 5, "level": 3}
+	attrs := []attribute.KeyValue{attribute.String("msg", "oops"), attribute.String("Latency", "high"),
+		attribute.String("queue", "low")}
+
+	emf.Write(metrics, values, attrs)
+	emf.Write(metrics, values, attrs)
+
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	// The warnings are only logged once per key
+	assert.Equal(t, 5, len(lines))
+	assert.Equal(t, `{"level":"warn","msg":"The EMF key clashes with a metric or a log entry key, skipping it",`+
+		`"key":"level"}`, lines[0])
+
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[3]), &line))
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "Metrics", line["msg"])
+	assert.Equal(t, 5.0, line["Latency"])
+	assert.Equal(t, "low", line["queue"])
+
+	aws, err := json.Marshal(line["_aws"])
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Timestamp":1700000000000,"CloudWatchMetrics":[{"Namespace":"Workers",
+		"Dimensions":[["queue"]],"Metrics":[{"Name":"Latency","Unit":"Milliseconds"}]}]}`, string(aws))
+}
+
+func TestEMFCardinalityLimits(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, _ := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	obs.MeterController = noop.NewMeterProvider()
+	obs.Cardinality = NewCardinalityLimiter(zap.NewNop(), CardinalityLimits{PerMetric: 1})
+	obs.EMF = NewEMFSink(logger, "Workers")
+
+	for _, user := range []string{"alice", "bob"} {
+		mh := obs.MakeMetricHelper(context.Background())
+		mh.SetTag("user", user)
+		mh.AddCount("Requests", 1)
+		mh.Close()
+	}
+
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, strings.Contains(lines[0], `"user":"alice"`))
+	// The series over the limit is written with the overflow dimension instead
+	assert.False(t, strings.Contains(lines[1], `"user"`))
+	assert.True(t, strings.Contains(lines[1], `"otel.metric.overflow":"true"`))
+}
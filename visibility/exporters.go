@@ -0,0 +1,358 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/aggregation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"strings"
+	"time"
+)
+
+// ExporterProtocol is the OTLP transport protocol
+type ExporterProtocol string
+
+const (
+	ProtocolGRPC ExporterProtocol = "grpc"
+	ProtocolHTTP ExporterProtocol = "http/protobuf"
+)
+
+// SpanFilter decides whether a finished span is sent to the exporter
+type SpanFilter func(span sdktrace.ReadOnlySpan) bool
+
+// CanarySpansOnly passes only the spans of the canary requests, see IsCanaryRequest
+func CanarySpansOnly(span sdktrace.ReadOnlySpan) bool {
+	for _, a := range span.Attributes() {
+		if string(a.Key) == CanaryAttributeName {
+			return a.Value.AsBool()
+		}
+	}
+	return false
+}
+
+// NonCanarySpansOnly passes only the spans of the real customer requests
+func NonCanarySpansOnly(span sdktrace.ReadOnlySpan) bool {
+	return !CanarySpansOnly(span)
+}
+
+// ErrorSpansOnly passes only the spans that ended with the error status
+func ErrorSpansOnly(span sdktrace.ReadOnlySpan) bool {
+	return span.Status().Code == codes.Error
+}
+
+// TraceExporterOptions describe one of the trace backends. Each backend has its own
+// batching queue, so a slow backend can not block the other ones (its queue simply
+// overflows and the spans are dropped).
+type TraceExporterOptions struct {
+	Endpoint string
+	Protocol ExporterProtocol // gRPC is the default
+	UseTLS   bool
+	Headers  map[string]string
+
+	// Only the spans that pass the filter are exported, all the spans are exported if it's nil
+	Filter SpanFilter
+
+	BatchTimeout       time.Duration // 5 seconds by default
+	MaxExportBatchSize int           // 10 by default
+	MaxQueueSize       int           // 2048 by default
+
+	// If set, the batches are spooled into this directory before being sent, so they are
+	// not lost if the collector is unreachable or the process restarts. The directory
+	// is private to the exporter, two exporters must not share it.
+	PersistentQueueDir string
+	// The oldest batches are discarded once the directory grows above this
+	// limit, DefaultPersistentQueueMaxBytes by default
+	PersistentQueueMaxBytes int64
+}
+
+// MetricFilter decides whether a data point of the metric is sent to the exporter
+type MetricFilter func(scope instrumentation.Scope, name string, attrs attribute.Set) bool
+
+// MetricNamePrefixFilter passes only the metrics whose names start with one of the prefixes
+func MetricNamePrefixFilter(prefixes ...string) MetricFilter {
+	return func(_ instrumentation.Scope, name string, _ attribute.Set) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(name, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// CanaryMetricsOnly passes only the metrics of the canary requests, they have the canary
+// attribute unless the Observer's CanaryMetricPrefix is set
+func CanaryMetricsOnly(_ instrumentation.Scope, _ string, attrs attribute.Set) bool {
+	val, ok := attrs.Value(CanaryAttributeName)
+	return ok && val.AsBool()
+}
+
+// NonCanaryMetricsOnly passes only the metrics of the real customer requests
+func NonCanaryMetricsOnly(scope instrumentation.Scope, name string, attrs attribute.Set) bool {
+	return !CanaryMetricsOnly(scope, name, attrs)
+}
+
+// MetricExporterOptions describe one of the metric backends. Each backend has its own
+// periodic reader, so a slow backend does not delay the collection for the other ones.
+type MetricExporterOptions struct {
+	Endpoint string
+	Protocol ExporterProtocol // gRPC is the default
+	UseTLS   bool
+	Headers  map[string]string
+
+	// Only the data points that pass the filter are exported, everything is exported if it's nil
+	Filter MetricFilter
+
+	Interval time.Duration // 2 seconds by default
+	Timeout  time.Duration // 2 seconds by default
+}
+
+func newTraceClient(o TraceExporterOptions) (otlptrace.Client, error) {
+	// The persistent queue does its own retries, and the in-client retries would
+	// block the queue for minutes
+	retry := o.PersistentQueueDir == ""
+
+	switch o.Protocol {
+	case "", ProtocolGRPC:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(o.Endpoint)}
+		if !o.UseTLS {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(o.Headers) != 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(o.Headers))
+		}
+		if !retry {
+			opts = append(opts, otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{Enabled: false}))
+		}
+		return otlptracegrpc.NewClient(opts...), nil
+	case ProtocolHTTP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(o.Endpoint)}
+		if !o.UseTLS {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(o.Headers) != 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(o.Headers))
+		}
+		if !retry {
+			opts = append(opts, otlptracehttp.WithRetry(otlptracehttp.RetryConfig{Enabled: false}))
+		}
+		return otlptracehttp.NewClient(opts...), nil
+	}
+	return nil, fmt.Errorf("unsupported trace exporter protocol: %s", o.Protocol)
+}
+
+func newSpanProcessor(o TraceExporterOptions, tel *selfTelemetry) (sdktrace.SpanProcessor, error) {
+	client, err := newTraceClient(o)
+	if err != nil {
+		return nil, err
+	}
+	if o.PersistentQueueDir != "" {
+		client = newPersistentTraceClient(client, o.PersistentQueueDir, o.PersistentQueueMaxBytes,
+			tel, o.Endpoint)
+	}
+	otlpExporter, err := otlptrace.New(context.Background(), client)
+	if err != nil {
+		return nil, err
+	}
+	exporter := newInstrumentedSpanExporter(otlpExporter, tel, o.Endpoint)
+	exporter.spooled = o.PersistentQueueDir != ""
+
+	batchTimeout := o.BatchTimeout
+	if batchTimeout == 0 {
+		batchTimeout = 5 * time.Second
+	}
+	batchSize := o.MaxExportBatchSize
+	if batchSize == 0 {
+		batchSize = 10
+	}
+	queueSize := o.MaxQueueSize
+	if queueSize == 0 {
+		queueSize = sdktrace.DefaultMaxQueueSize
+	}
+	bsp := sdktrace.NewBatchSpanProcessor(exporter,
+		sdktrace.WithBatchTimeout(batchTimeout),
+		sdktrace.WithMaxExportBatchSize(batchSize),
+		sdktrace.WithMaxQueueSize(queueSize),
+	)
+
+	var res sdktrace.SpanProcessor = newBoundedSpanProcessor(bsp, exporter, queueSize)
+	if o.Filter != nil {
+		res = &filteringSpanProcessor{SpanProcessor: res, filter: o.Filter}
+	}
+	return res, nil
+}
+
+func newMetricExporter(o MetricExporterOptions) (sdkmetric.Exporter, error) {
+	switch o.Protocol {
+	case "", ProtocolGRPC:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(o.Endpoint)}
+		if !o.UseTLS {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		if len(o.Headers) != 0 {
+			opts = append(opts, otlpmetricgrpc.WithHeaders(o.Headers))
+		}
+		return otlpmetricgrpc.New(context.Background(), opts...)
+	case ProtocolHTTP:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(o.Endpoint)}
+		if !o.UseTLS {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		if len(o.Headers) != 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(o.Headers))
+		}
+		return otlpmetrichttp.New(context.Background(), opts...)
+	}
+	return nil, fmt.Errorf("unsupported metric exporter protocol: %s", o.Protocol)
+}
+
+func newMetricReader(o MetricExporterOptions, tel *selfTelemetry) (sdkmetric.Reader, error) {
+	otlpExporter, err := newMetricExporter(o)
+	if err != nil {
+		return nil, err
+	}
+	var exporter sdkmetric.Exporter = newInstrumentedMetricExporter(otlpExporter, tel, o.Endpoint)
+	if o.Filter != nil {
+		exporter = &filteringMetricExporter{Exporter: exporter, filter: o.Filter}
+	}
+
+	interval := o.Interval
+	if interval == 0 {
+		interval = 2 * time.Second
+	}
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+
+	return sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(interval),
+		sdkmetric.WithTimeout(timeout),
+	), nil
+}
+
+// filteringSpanProcessor passes only the spans accepted by the filter to the
+// wrapped processor
+type filteringSpanProcessor struct {
+	sdktrace.SpanProcessor
+	filter SpanFilter
+}
+
+func (f *filteringSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if f.filter(s) {
+		f.SpanProcessor.OnEnd(s)
+	}
+}
+
+// filteringMetricExporter passes only the data points accepted by the filter to the
+// wrapped exporter
+type filteringMetricExporter struct {
+	sdkmetric.Exporter
+	filter MetricFilter
+}
+
+func (f *filteringMetricExporter) Temporality(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+	return f.Exporter.Temporality(kind)
+}
+
+func (f *filteringMetricExporter) Aggregation(kind sdkmetric.InstrumentKind) aggregation.Aggregation {
+	return f.Exporter.Aggregation(kind)
+}
+
+func (f *filteringMetricExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	return f.Exporter.Export(ctx, filterResourceMetrics(rm, f.filter))
+}
+
+func filterResourceMetrics(rm *metricdata.ResourceMetrics, filter MetricFilter) *metricdata.ResourceMetrics {
+	res := &metricdata.ResourceMetrics{Resource: rm.Resource}
+
+	for _, sm := range rm.ScopeMetrics {
+		filtered := metricdata.ScopeMetrics{Scope: sm.Scope}
+		for _, m := range sm.Metrics {
+			keep := func(attrs attribute.Set) bool {
+				return filter(sm.Scope, m.Name, attrs)
+			}
+
+			var data metricdata.Aggregation
+			switch agg := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				agg.DataPoints = filterDataPoints(agg.DataPoints, keep)
+				if len(agg.DataPoints) != 0 {
+					data = agg
+				}
+			case metricdata.Sum[float64]:
+				agg.DataPoints = filterDataPoints(agg.DataPoints, keep)
+				if len(agg.DataPoints) != 0 {
+					data = agg
+				}
+			case metricdata.Gauge[int64]:
+				agg.DataPoints = filterDataPoints(agg.DataPoints, keep)
+				if len(agg.DataPoints) != 0 {
+					data = agg
+				}
+			case metricdata.Gauge[float64]:
+				agg.DataPoints = filterDataPoints(agg.DataPoints, keep)
+				if len(agg.DataPoints) != 0 {
+					data = agg
+				}
+			case metricdata.Histogram[int64]:
+				agg.DataPoints = filterHistogramDataPoints(agg.DataPoints, keep)
+				if len(agg.DataPoints) != 0 {
+					data = agg
+				}
+			case metricdata.Histogram[float64]:
+				agg.DataPoints = filterHistogramDataPoints(agg.DataPoints, keep)
+				if len(agg.DataPoints) != 0 {
+					data = agg
+				}
+			default:
+				// Pass through the aggregations that we don't know about
+				data = m.Data
+			}
+
+			if data != nil {
+				m.Data = data
+				filtered.Metrics = append(filtered.Metrics, m)
+			}
+		}
+		if len(filtered.Metrics) != 0 {
+			res.ScopeMetrics = append(res.ScopeMetrics, filtered)
+		}
+	}
+
+	return res
+}
+
+func filterDataPoints[N int64 | float64](points []metricdata.DataPoint[N],
+	keep func(attribute.Set) bool) []metricdata.DataPoint[N] {
+
+	var res []metricdata.DataPoint[N]
+	for _, p := range points {
+		if keep(p.Attributes) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func filterHistogramDataPoints[N int64 | float64](points []metricdata.HistogramDataPoint[N],
+	keep func(attribute.Set) bool) []metricdata.HistogramDataPoint[N] {
+
+	var res []metricdata.HistogramDataPoint[N]
+	for _, p := range points {
+		if keep(p.Attributes) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
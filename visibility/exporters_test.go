@@ -0,0 +1,257 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	collectormetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func spanNames(rs []*collectortracepb.ExportTraceServiceRequest) []string {
+	var res []string
+	for _, r := range rs {
+		for _, s := range r.ResourceSpans {
+			for _, ss := range s.ScopeSpans {
+				for _, sp := range ss.Spans {
+					res = append(res, sp.Name)
+				}
+			}
+		}
+	}
+	return res
+}
+
+func TestTraceFanOut(t *testing.T) {
+	allCollector := runMockCollector(t)
+	t.Cleanup(allCollector.Stop)
+	errCollector := runMockCollector(t)
+	t.Cleanup(errCollector.Stop)
+
+	var mtx sync.Mutex
+	var httpRequests []*collectortracepb.ExportTraceServiceRequest
+	httpCollector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &collectortracepb.ExportTraceServiceRequest{}
+		assert.NoError(t, proto.Unmarshal(body, req))
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+
+		mtx.Lock()
+		httpRequests = append(httpRequests, req)
+		mtx.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		resp, _ := proto.Marshal(&collectortracepb.ExportTraceServiceResponse{})
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(httpCollector.Close)
+
+	opts := NewBlindObserverOptions()
+	opts.LibraryName = "ArgusApp"
+	opts.IdGenerator = NewPredictableIdGen(123)
+	opts.TracingEndpoint = allCollector.endpoint
+	opts.TraceExporters = []TraceExporterOptions{
+		{Endpoint: errCollector.endpoint, Filter: ErrorSpansOnly},
+		{Endpoint: strings.TrimPrefix(httpCollector.URL, "http://"),
+			Protocol: ProtocolHTTP, Filter: CanarySpansOnly},
+	}
+
+	obs, err := NewObserver(zap.NewNop(), opts)
+	assert.NoError(t, err)
+
+	sp, _ := BeginNewSpan(context.Background(), obs, "GoodSpan")
+	CleanupSpan(sp)
+	sp, _ = BeginNewSpan(context.Background(), obs, "BadSpan")
+	CleanupWithErr(sp, fmt.Errorf("bad"))
+	sp, _ = BeginNewSpan(MarkAsCanary(context.Background(), true), obs, "CanarySpan")
+	CleanupSpan(sp)
+
+	obs.Shutdown(context.Background())
+
+	allSpans, _ := allCollector.Get()
+	assert.Equal(t, []string{"GoodSpan", "BadSpan", "CanarySpan"},
+		spanNames([]*collectortracepb.ExportTraceServiceRequest{{ResourceSpans: allSpans}}))
+
+	errSpans, _ := errCollector.Get()
+	assert.Equal(t, []string{"BadSpan"},
+		spanNames([]*collectortracepb.ExportTraceServiceRequest{{ResourceSpans: errSpans}}))
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, []string{"CanarySpan"}, spanNames(httpRequests))
+}
+
+func TestMetricFanOut(t *testing.T) {
+	allCollector := runMockCollector(t)
+	t.Cleanup(allCollector.Stop)
+	dbCollector := runMockCollector(t)
+	t.Cleanup(dbCollector.Stop)
+
+	opts := NewBlindObserverOptions()
+	opts.LibraryName = "ArgusApp"
+	opts.MetricExporters = []MetricExporterOptions{
+		{Endpoint: allCollector.endpoint, Interval: 50 * time.Millisecond},
+		{Endpoint: dbCollector.endpoint, Interval: 50 * time.Millisecond,
+			Filter: MetricNamePrefixFilter("db.")},
+	}
+
+	obs, err := NewObserver(zap.NewNop(), opts)
+	assert.NoError(t, err)
+	defer obs.Shutdown(context.Background())
+
+	mh := obs.MakeMetricHelper(context.Background())
+	mh.AddCount("db.Queries", 1)
+	mh.AddCount("http.Requests", 1)
+	mh.Close()
+
+	metricNames := func(mc *mockCollector) map[string]bool {
+		res := make(map[string]bool)
+		_, rms := mc.Get()
+		for _, rm := range rms {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					res[m.Name] = true
+				}
+			}
+		}
+		return res
+	}
+
+	assert.Eventually(t, func() bool {
+		return metricNames(allCollector)["http.Requests"] && metricNames(dbCollector)["db.Queries"]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.True(t, metricNames(allCollector)["db.Queries"])
+	assert.False(t, metricNames(dbCollector)["http.Requests"])
+}
+
+func TestFilterResourceMetrics(t *testing.T) {
+	canary := attribute.NewSet(attribute.Bool(CanaryAttributeName, true))
+	regular := attribute.NewSet()
+
+	rm := &metricdata.ResourceMetrics{
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope: instrumentation.Scope{Name: "ArgusApp"},
+			Metrics: []metricdata.Metrics{
+				{Name: "Sum", Data: metricdata.Sum[float64]{DataPoints: []metricdata.DataPoint[float64]{
+					{Attributes: canary, Value: 1}, {Attributes: regular, Value: 2}}}},
+				{Name: "Hist", Data: metricdata.Histogram[float64]{
+					DataPoints: []metricdata.HistogramDataPoint[float64]{{Attributes: regular, Count: 1}}}},
+			},
+		}},
+	}
+
+	onlyCanary := func(_ instrumentation.Scope, _ string, attrs attribute.Set) bool {
+		val, ok := attrs.Value(CanaryAttributeName)
+		return ok && val.AsBool()
+	}
+
+	filtered := filterResourceMetrics(rm, onlyCanary)
+	assert.Equal(t, 1, len(filtered.ScopeMetrics[0].Metrics))
+	sum := filtered.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[float64])
+	assert.Equal(t, 1, len(sum.DataPoints))
+	assert.Equal(t, 1., sum.DataPoints[0].Value)
+
+	// The original data is not modified
+	assert.Equal(t, 2, len(rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[float64]).DataPoints))
+
+	filtered = filterResourceMetrics(rm, func(instrumentation.Scope, string, attribute.Set) bool {
+		return false
+	})
+	assert.Empty(t, filtered.ScopeMetrics)
+}
+
+func TestHTTPMetricExporter(t *testing.T) {
+	var mtx sync.Mutex
+	var names []string
+	httpCollector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &collectormetricpb.ExportMetricsServiceRequest{}
+		assert.NoError(t, proto.Unmarshal(body, req))
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+
+		mtx.Lock()
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					names = append(names, m.Name)
+				}
+			}
+		}
+		mtx.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		resp, _ := proto.Marshal(&collectormetricpb.ExportMetricsServiceResponse{})
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(httpCollector.Close)
+
+	opts := NewBlindObserverOptions()
+	opts.LibraryName = "ArgusApp"
+	opts.MetricExporters = []MetricExporterOptions{
+		{Endpoint: strings.TrimPrefix(httpCollector.URL, "http://"), Protocol: ProtocolHTTP,
+			Interval: 50 * time.Millisecond},
+	}
+
+	obs, err := NewObserver(zap.NewNop(), opts)
+	assert.NoError(t, err)
+	defer obs.Shutdown(context.Background())
+
+	mh := obs.MakeMetricHelper(context.Background())
+	mh.AddCount("http.Requests", 1)
+	mh.Close()
+
+	assert.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, n := range names {
+			if n == "http.Requests" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBadExporterProtocol(t *testing.T) {
+	opts := NewBlindObserverOptions()
+	opts.MetricExporters = []MetricExporterOptions{{Endpoint: "localhost:4317", Protocol: "carrier-pigeon"}}
+	_, err := NewObserver(zap.NewNop(), opts)
+	assert.ErrorContains(t, err, "unsupported metric exporter protocol")
+
+	opts = NewBlindObserverOptions()
+	opts.TraceExporters = []TraceExporterOptions{{Endpoint: "localhost:4317", Protocol: "carrier-pigeon"}}
+	_, err = NewObserver(zap.NewNop(), opts)
+	assert.ErrorContains(t, err, "unsupported trace exporter protocol")
+}
+
+func TestFailedObserverIsShutDown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// The exporters that were already built must not leak their goroutines
+	opts := NewBlindObserverOptions()
+	opts.MetricExporters = []MetricExporterOptions{{Endpoint: "localhost:4317"}}
+	opts.TraceExporters = []TraceExporterOptions{
+		{Endpoint: "localhost:4317"},
+		{Endpoint: "localhost:4317", Protocol: "carrier-pigeon"},
+	}
+	_, err := NewObserver(zap.NewNop(), opts)
+	assert.ErrorContains(t, err, "unsupported trace exporter protocol")
+
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= before
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,124 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// GaugeOption customizes the gauges registered by Observer.RegisterGauge and RegisterGauges
+type GaugeOption func(cfg *gaugeConfig)
+
+type gaugeConfig struct {
+	description string
+	attrs       []attribute.KeyValue
+}
+
+// WithGaugeDescription sets the description of the gauges
+func WithGaugeDescription(description string) GaugeOption {
+	return func(cfg *gaugeConfig) {
+		cfg.description = description
+	}
+}
+
+// WithGaugeAttributes adds the attributes to all the values of the gauges, in addition
+// to the Observer's MetricAttributes
+func WithGaugeAttributes(attrs ...attribute.KeyValue) GaugeOption {
+	return func(cfg *gaugeConfig) {
+		cfg.attrs = append(cfg.attrs, attrs...)
+	}
+}
+
+// GaugeObserver reports the values of the gauges in the RegisterGauges callback
+type GaugeObserver struct {
+	observer metric.Observer
+	gauges   map[string]registeredGauge
+	attrs    []attribute.KeyValue
+	err      error
+}
+
+type registeredGauge struct {
+	instrument metric.Float64ObservableGauge
+	// The declared unit, if the values are converted to the base unit (see Observer.NormalizeUnits)
+	normalizeFrom string
+}
+
+// Observe reports the current value of the gauge, the attributes are added to the
+// ones from the options. Observing a gauge that was not registered is an error, it's
+// returned from the callback.
+func (g *GaugeObserver) Observe(name string, val float64, attrs ...attribute.KeyValue) {
+	gauge, ok := g.gauges[name]
+	if !ok {
+		if g.err == nil {
+			g.err = fmt.Errorf("the gauge %s is not registered", name)
+		}
+		return
+	}
+	if gauge.normalizeFrom != "" {
+		val = Quantity{Value: val, Unit: gauge.normalizeFrom}.Normalized().Value
+	}
+	if len(attrs) == 0 {
+		g.observer.ObserveFloat64(gauge.instrument, val, metric.WithAttributes(g.attrs...))
+		return
+	}
+	g.observer.ObserveFloat64(gauge.instrument, val, metric.WithAttributes(appendAttrs(g.attrs, attrs)...))
+}
+
+// RegisterGauge publishes the value returned by the callback as a gauge (e.g. a pool size
+// or a queue depth). The callback is invoked during each collection cycle of the
+// MeterController, so it must be fast and thread-safe. It's never invoked if the metrics
+// are disabled. Use the returned registration to stop publishing the gauge.
+func (o *Observer) RegisterGauge(name, unit string, callback func() float64,
+	options ...GaugeOption) (metric.Registration, error) {
+
+	return o.RegisterGauges(func(_ context.Context, g *GaugeObserver) error {
+		g.Observe(name, callback())
+		return nil
+	}, []NamedMetric{{Name: name, Unit: unit}}, options...)
+}
+
+// RegisterGauges publishes multiple gauges from a single callback, which is convenient
+// when the values are read together (e.g. from the same stats structure). The callback
+// can report several values with the different attributes for each gauge. The values
+// are converted to the base units if the Observer's NormalizeUnits is set.
+func (o *Observer) RegisterGauges(callback func(ctx context.Context, g *GaugeObserver) error,
+	gauges []NamedMetric, options ...GaugeOption) (metric.Registration, error) {
+
+	cfg := gaugeConfig{}
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	meter := o.MeterController.Meter(o.DefaultLibraryName)
+	byName := make(map[string]registeredGauge, len(gauges))
+	observables := make([]metric.Observable, 0, len(gauges))
+	for _, nm := range gauges {
+		if err := ValidateUnit(nm.Unit); err != nil {
+			return nil, fmt.Errorf("gauge %s: %w", nm.Name, err)
+		}
+		var gauge registeredGauge
+		unit := nm.Unit
+		if o.NormalizeUnits {
+			gauge.normalizeFrom = nm.Unit
+			unit = Quantity{Value: 1, Unit: nm.Unit}.Normalized().Unit
+		}
+		inst, err := meter.Float64ObservableGauge(nm.Name, metric.WithUnit(unit),
+			metric.WithDescription(cfg.description))
+		if err != nil {
+			return nil, err
+		}
+		gauge.instrument = inst
+		byName[nm.Name] = gauge
+		observables = append(observables, inst)
+	}
+
+	attrs := appendAttrs(o.MetricAttributes, cfg.attrs)
+	return meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		g := &GaugeObserver{observer: observer, gauges: byName, attrs: attrs}
+		if err := callback(ctx, g); err != nil {
+			return err
+		}
+		return g.err
+	}, observables...)
+}
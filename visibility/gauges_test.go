@@ -0,0 +1,120 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func collectGauges(t *testing.T, reader sdkmetric.Reader, expectErr bool) map[string][]metricdata.DataPoint[float64] {
+	rm := metricdata.ResourceMetrics{}
+	err := reader.Collect(context.Background(), &rm)
+	if expectErr {
+		assert.Error(t, err)
+	} else {
+		assert.NoError(t, err)
+	}
+	res := map[string][]metricdata.DataPoint[float64]{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			res[m.Name] = m.Data.(metricdata.Gauge[float64]).DataPoints
+		}
+	}
+	return res
+}
+
+func TestRegisterGauge(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	obs.MetricAttributes = []attribute.KeyValue{attribute.String("service", "storage")}
+
+	poolSize := 3.0
+	reg, err := obs.RegisterGauge("PoolSize", "{connections}", func() float64 { return poolSize },
+		WithGaugeAttributes(attribute.String("pool", "db")), WithGaugeDescription("Open connections"))
+	assert.NoError(t, err)
+
+	gauges := collectGauges(t, reader, false)
+	assert.Equal(t, 3.0, gauges["PoolSize"][0].Value)
+	assert.Equal(t, attribute.NewSet(attribute.String("service", "storage"), attribute.String("pool", "db")),
+		gauges["PoolSize"][0].Attributes)
+
+	poolSize = 5
+	assert.Equal(t, 5.0, collectGauges(t, reader, false)["PoolSize"][0].Value)
+
+	assert.NoError(t, reg.Unregister())
+	assert.Empty(t, collectGauges(t, reader, false)["PoolSize"])
+
+	_, err = obs.RegisterGauge("Bad", "bytes", func() float64 { return 0 })
+	assert.ErrorContains(t, err, `gauge Bad: unknown unit: "bytes"`)
+}
+
+func TestRegisterGauges(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	reportUnknown := false
+	reg, err := obs.RegisterGauges(func(ctx context.Context, g *GaugeObserver) error {
+		g.Observe("QueueDepth", 10, attribute.String("queue", "high"))
+		g.Observe("QueueDepth", 20, attribute.String("queue", "low"))
+		g.Observe("QueueBytes", 2048)
+		if reportUnknown {
+			g.Observe("Unknown", 1)
+		}
+		return nil
+	}, []NamedMetric{Named("QueueDepth", Dimensionless), Named("QueueBytes", UnitBytes)})
+	assert.NoError(t, err)
+
+	gauges := collectGauges(t, reader, false)
+	assert.Equal(t, 2, len(gauges["QueueDepth"]))
+	assert.Equal(t, 2048.0, gauges["QueueBytes"][0].Value)
+
+	reportUnknown = true
+	gauges = collectGauges(t, reader, true)
+	assert.Equal(t, 2048.0, gauges["QueueBytes"][0].Value)
+	assert.NoError(t, reg.Unregister())
+
+	// Nothing is invoked with the metrics disabled
+	obs.MeterController = noop.NewMeterProvider()
+	reg, err = obs.RegisterGauge("PoolSize", Dimensionless, func() float64 {
+		t.Fatal("must not be called")
+		return 0
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, reg.Unregister())
+}
+
+func TestGaugeUnitNormalization(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	obs.NormalizeUnits = true
+
+	reg, err := obs.RegisterGauges(func(ctx context.Context, g *GaugeObserver) error {
+		g.Observe("CacheSize", 2)
+		g.Observe("Lag", 1500)
+		return nil
+	}, []NamedMetric{Named("CacheSize", UnitKibiBytes), Named("Lag", UnitMilliseconds)})
+	assert.NoError(t, err)
+	defer reg.Unregister()
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	units := map[string]string{}
+	values := map[string]float64{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		units[m.Name] = m.Unit
+		values[m.Name] = m.Data.(metricdata.Gauge[float64]).DataPoints[0].Value
+	}
+	assert.Equal(t, map[string]string{"CacheSize": BaseUnit(UnitKibiBytes), "Lag": UnitSeconds}, units)
+	assert.Equal(t, map[string]float64{"CacheSize": 2048, "Lag": 1.5}, values)
+}
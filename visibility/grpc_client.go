@@ -0,0 +1,170 @@
+package visibility
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync"
+)
+
+func beginGRPCClientSpan(ctx context.Context, obs *Observer, cfg *GRPCConfig,
+	fullMethod string) (trace.Span, context.Context) {
+
+	name, attrs := splitFullMethod(fullMethod)
+	sp, ctx := BeginNewSpan(ctx, obs, name, grpcSpanOptions(cfg, trace.SpanKindClient, attrs)...)
+
+	// The metadata in the context must not be modified, it can be shared with other calls
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	obs.textMapPropagator().Inject(ctx, metadataCarrier(md))
+	if requestID := RequestIDFromContext(ctx); requestID != "" && len(md.Get(requestIDMetadataKey)) == 0 {
+		// For the servers that don't understand the baggage
+		md.Set(requestIDMetadataKey, requestID)
+	}
+
+	return sp, metadata.NewOutgoingContext(ctx, md)
+}
+
+// NewUnaryClientInterceptor creates the interceptor that runs each call inside a client
+// span started by BeginNewSpan with metrics. The trace context and baggage (including the
+// canary flag) are injected into the outgoing metadata.
+//
+// The calls are counted with the "rpc.service" and "rpc.method" attributes as:
+// <Base>Success=1 for the OK status
+// <Base>Error=1 for all the other status codes
+// <Base>Fault=1 if the invoker panics
+//
+// The base is "GRPCClient" by default, so the client and server metrics are not mixed up
+// if a service calls itself.
+func NewUnaryClientInterceptor(obs *Observer, options ...GRPCOption) grpc.UnaryClientInterceptor {
+	cfg := makeGRPCConfig("GRPCClient", options)
+
+	return func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+		sp, ctx := beginGRPCClientSpan(ctx, obs, &cfg, method)
+		defer CleanupSpan(sp)
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		sp.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(status.Code(err))))
+		if err != nil {
+			sp.RecordError(err)
+			sp.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	}
+}
+
+// NewStreamClientInterceptor is the streaming counterpart of NewUnaryClientInterceptor. It
+// also counts the messages in the <Base>MessagesReceived and <Base>MessagesSent metrics.
+//
+// The span is finished when the stream ends: when RecvMsg returns an error or io.EOF,
+// or when the call context is done. Make sure to do either, or the span will leak.
+func NewStreamClientInterceptor(obs *Observer, options ...GRPCOption) grpc.StreamClientInterceptor {
+	cfg := makeGRPCConfig("GRPCClient", options)
+
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+
+		sp, ctx := beginGRPCClientSpan(ctx, obs, &cfg, method)
+
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		stream := &countingClientStream{
+			ClientStream:  cs,
+			span:          sp,
+			mh:            GetMetricHelperFromContext(ctx),
+			serverStreams: desc.ServerStreams,
+			done:          make(chan struct{}),
+		}
+		if err != nil {
+			stream.finish(err)
+			return nil, err
+		}
+
+		go func() {
+			select {
+			case <-stream.done:
+			case <-ctx.Done():
+				stream.finish(status.FromContextError(ctx.Err()).Err())
+			}
+		}()
+
+		return stream, nil
+	}
+}
+
+// countingClientStream counts the messages and finishes the span when the stream ends
+type countingClientStream struct {
+	grpc.ClientStream
+	span          trace.Span
+	mh            *MetricHelper
+	serverStreams bool
+
+	mtx sync.Mutex
+	messageCounter
+	once sync.Once
+	done chan struct{}
+}
+
+func (s *countingClientStream) finish(err error) {
+	s.once.Do(func() {
+		s.mtx.Lock()
+		s.submitCounts(s.span, s.mh)
+		s.mtx.Unlock()
+
+		s.span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(status.Code(err))))
+		doCleanupWithErr(s.span, err, nil)
+		close(s.done)
+	})
+}
+
+func (s *countingClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.mtx.Lock()
+		s.sent++
+		s.mtx.Unlock()
+	}
+	// The errors from SendMsg don't carry the call status, RecvMsg returns it
+	return err
+}
+
+func (s *countingClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.finish(nil)
+		return err
+	}
+	if err != nil {
+		s.finish(err)
+		return err
+	}
+
+	s.mtx.Lock()
+	s.received++
+	s.mtx.Unlock()
+
+	if !s.serverStreams {
+		// The client-streaming calls get only one response, and the callers
+		// don't read until io.EOF after it
+		s.finish(nil)
+	}
+	return nil
+}
+
+func (s *countingClientStream) Header() (metadata.MD, error) {
+	md, err := s.ClientStream.Header()
+	if err != nil {
+		s.finish(err)
+	}
+	return md, err
+}
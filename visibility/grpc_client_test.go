@@ -0,0 +1,121 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func dialInstrumented(t *testing.T, obs *Observer) (*mockCollector, *grpc.ClientConn) {
+	mc := runMockCollectorWithOptions(t,
+		grpc.ChainUnaryInterceptor(NewUnaryServerInterceptor(obs)),
+		grpc.ChainStreamInterceptor(NewStreamServerInterceptor(obs)))
+	t.Cleanup(mc.Stop)
+
+	conn, err := grpc.Dial(mc.endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(NewUnaryClientInterceptor(obs)),
+		grpc.WithChainStreamInterceptor(NewStreamClientInterceptor(obs)))
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return mc, conn
+}
+
+func TestGRPCUnaryClientInterceptor(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	_, conn := dialInstrumented(t, obs)
+
+	ctx := MarkAsCanary(context.Background(), true)
+	_, err := collectortracepb.NewTraceServiceClient(conn).Export(ctx,
+		&collectortracepb.ExportTraceServiceRequest{})
+	assert.NoError(t, err)
+
+	values := rec.Get()
+	assert.Equal(t, 2, len(values.Spans))
+	serverSpan, clientSpan := values.Spans[0], values.Spans[1]
+	assert.Equal(t, "opentelemetry.proto.collector.trace.v1.TraceService/Export", clientSpan.Name())
+	assert.Equal(t, trace.SpanKindClient, clientSpan.SpanKind())
+	assert.Equal(t, clientSpan.SpanContext().SpanID(), serverSpan.Parent().SpanID())
+
+	// The canary flag is propagated to the server
+	serverAttrs := attribute.NewSet(serverSpan.Attributes()...)
+	canary, _ := serverAttrs.Value(CanaryAttributeName)
+	assert.True(t, canary.AsBool())
+
+	assert.Equal(t, 1., values.Metrics["GRPCClientSuccess"])
+	assert.Equal(t, 1., values.Metrics["GRPCServerSuccess"])
+
+	// The health service doesn't know this service
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(),
+		&healthpb.HealthCheckRequest{Service: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	values = rec.Get()
+	assert.Equal(t, 1., values.Metrics["GRPCClientError"])
+	assert.Equal(t, 0., values.Metrics["GRPCClientFault"])
+	assert.Equal(t, otelcodes.Error, values.Spans[1].Status().Code)
+	checkAttrs := attribute.NewSet(values.Spans[1].Attributes()...)
+	code, _ := checkAttrs.Value("rpc.grpc.status_code")
+	assert.Equal(t, int64(codes.NotFound), code.AsInt64())
+}
+
+func TestGRPCStreamClientInterceptor(t *testing.T) {
+	obs, rec := NewDeltaRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	_, conn := dialInstrumented(t, obs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watch, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+
+	resp, err := watch.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	// The Watch never ends by itself, the client span is finished when the context is done
+	cancel()
+
+	const base = "GRPCClient"
+	// Get() drains the recorder, so accumulate the results while waiting
+	var values Record
+	assert.Eventually(t, func() bool {
+		cur := rec.Get()
+		values.Spans = append(values.Spans, cur.Spans...)
+		if values.Metrics == nil {
+			values.Metrics = make(map[string]float64)
+		}
+		for k, v := range cur.Metrics {
+			values.Metrics[k] += v
+		}
+		return values.Metrics[base+"Error"] == 1.
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 1., values.Metrics[base+"MessagesReceived"])
+	assert.Equal(t, 1., values.Metrics[base+"MessagesSent"])
+
+	var clientSpan sdktrace.ReadOnlySpan
+	for _, s := range values.Spans {
+		if s.SpanKind() == trace.SpanKindClient {
+			clientSpan = s
+		}
+	}
+	assert.NotNil(t, clientSpan)
+	attrs := attribute.NewSet(clientSpan.Attributes()...)
+	code, _ := attrs.Value("rpc.grpc.status_code")
+	assert.Equal(t, int64(codes.Canceled), code.AsInt64())
+}
@@ -0,0 +1,246 @@
+package visibility
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// GRPCConfig is the configuration of the gRPC interceptors
+type GRPCConfig struct {
+	// The base for the metric names, "GRPCServer" or "GRPCClient" by default
+	MetricNameBase string
+
+	// Additional options for the spans
+	SpanOptions []BeginSpanOption
+}
+
+// GRPCOption is used to customize the gRPC interceptors
+type GRPCOption func(cfg *GRPCConfig)
+
+// WithGRPCMetricNameBase overrides the "GRPCServer" or "GRPCClient" metric name base
+func WithGRPCMetricNameBase(base string) GRPCOption {
+	return func(cfg *GRPCConfig) {
+		cfg.MetricNameBase = base
+	}
+}
+
+// WithGRPCSpanOptions adds the options for the spans, e.g. WithCustomMetricPrefix
+func WithGRPCSpanOptions(options ...BeginSpanOption) GRPCOption {
+	return func(cfg *GRPCConfig) {
+		cfg.SpanOptions = append(cfg.SpanOptions, options...)
+	}
+}
+
+func makeGRPCConfig(defaultBase string, options []GRPCOption) GRPCConfig {
+	cfg := GRPCConfig{MetricNameBase: defaultBase}
+	for _, o := range options {
+		o(&cfg)
+	}
+	return cfg
+}
+
+// requestIDMetadataKey is the gRPC counterpart of RequestIDHeader
+var requestIDMetadataKey = strings.ToLower(RequestIDHeader)
+
+// metadataCarrier adapts the gRPC metadata to propagation.TextMapCarrier
+type metadataCarrier metadata.MD
+
+var _ propagation.TextMapCarrier = metadataCarrier{}
+
+func (m metadataCarrier) Get(key string) string {
+	values := metadata.MD(m).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (m metadataCarrier) Set(key, value string) {
+	metadata.MD(m).Set(key, value)
+}
+
+func (m metadataCarrier) Keys() []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	return res
+}
+
+// splitFullMethod splits "/package.Service/Method" into the span name
+// "package.Service/Method" and the rpc.service and rpc.method attributes
+func splitFullMethod(fullMethod string) (string, []attribute.KeyValue) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	service, method := name, ""
+	if idx := strings.LastIndexByte(name, '/'); idx >= 0 {
+		service, method = name[:idx], name[idx+1:]
+	}
+	return name, []attribute.KeyValue{semconv.RPCServiceKey.String(service), semconv.RPCMethodKey.String(method)}
+}
+
+// grpcSpanOptions returns the options for the client and server spans, the metrics get
+// the rpc.service and rpc.method attributes
+func grpcSpanOptions(cfg *GRPCConfig, kind trace.SpanKind, attrs []attribute.KeyValue) []BeginSpanOption {
+	spanOpts := []BeginSpanOption{
+		WithMetrics(),
+		WithCustomMetricNameBase(cfg.MetricNameBase),
+		WithMetricAttributes(attrs...),
+		WithSpanStartOptions(trace.WithSpanKind(kind),
+			trace.WithAttributes(semconv.RPCSystemGRPC), trace.WithAttributes(attrs...)),
+	}
+	return append(spanOpts, cfg.SpanOptions...)
+}
+
+// isServerFault returns true for the status codes that signal a problem on the server
+// side, rather than a bad request
+func isServerFault(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal,
+		codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+func beginGRPCServerSpan(ctx context.Context, obs *Observer, cfg *GRPCConfig,
+	fullMethod string) (trace.Span, context.Context) {
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = obs.textMapPropagator().Extract(ctx, metadataCarrier(md))
+	ctx = obs.ContextWithRequestID(ctx, incomingRequestID(ctx, metadataCarrier(md).Get(requestIDMetadataKey)))
+
+	name, attrs := splitFullMethod(fullMethod)
+	return BeginNewSpan(ctx, obs, name, grpcSpanOptions(cfg, trace.SpanKindServer, attrs)...)
+}
+
+// finishGRPCServerSpan finishes the span according to the handler's result. If the handler
+// has panicked, the panic is recorded as a Fault and replaced with the codes.Internal error.
+func finishGRPCServerSpan(ctx context.Context, sp trace.Span, err error, thrownPanic any) error {
+	if thrownPanic != nil {
+		logging.L(ctx).Error("Panic in the gRPC handler",
+			zap.Any("panic", thrownPanic), zap.Stack("stacktrace"))
+		sp.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(codes.Internal)))
+		doCleanupWithErr(sp, nil, thrownPanic)
+		return status.Errorf(codes.Internal, "panic: %v", thrownPanic)
+	}
+
+	code := status.Code(err)
+	sp.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	if isServerFault(code) {
+		MarkAsFault(sp)
+	}
+	doCleanupWithErr(sp, err, nil)
+	return err
+}
+
+// NewUnaryServerInterceptor creates the interceptor that runs each call inside a server
+// span started by BeginNewSpan with metrics. The trace context and baggage are extracted
+// from the incoming metadata, and the handler's context gets the span and its logger.
+//
+// The request ID is taken from the x-request-id metadata or the baggage, or generated if
+// the client hasn't sent it. It's echoed in the x-request-id response header.
+//
+// The calls are counted with the "rpc.service" and "rpc.method" attributes as:
+// <Base>Success=1 for the OK status
+// <Base>Error=1 for the status codes caused by the client (e.g. InvalidArgument)
+// <Base>Fault=1 for the server-side failures (e.g. Internal or Unavailable) and panics
+//
+// The base is "GRPCServer" by default, see WithGRPCMetricNameBase.
+//
+// The panics are not re-thrown, the caller gets the codes.Internal error instead.
+func NewUnaryServerInterceptor(obs *Observer, options ...GRPCOption) grpc.UnaryServerInterceptor {
+	cfg := makeGRPCConfig("GRPCServer", options)
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (resp interface{}, err error) {
+
+		sp, ctx := beginGRPCServerSpan(ctx, obs, &cfg, info.FullMethod)
+		// Nothing can be done if the headers can't be sent, the call will fail anyway
+		_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadataKey, RequestIDFromContext(ctx)))
+		defer func() {
+			// recover() only works in the deferred function itself
+			thrownPanic := recover()
+			err = finishGRPCServerSpan(ctx, sp, err, thrownPanic)
+			if thrownPanic != nil {
+				resp = nil
+			}
+		}()
+
+		return handler(ctx, req)
+	}
+}
+
+// NewStreamServerInterceptor is the streaming counterpart of NewUnaryServerInterceptor. It
+// also counts the messages in the <Base>MessagesReceived and <Base>MessagesSent metrics.
+func NewStreamServerInterceptor(obs *Observer, options ...GRPCOption) grpc.StreamServerInterceptor {
+	cfg := makeGRPCConfig("GRPCServer", options)
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) (err error) {
+
+		sp, ctx := beginGRPCServerSpan(ss.Context(), obs, &cfg, info.FullMethod)
+		_ = ss.SetHeader(metadata.Pairs(requestIDMetadataKey, RequestIDFromContext(ctx)))
+		stream := &countingServerStream{ServerStream: ss, ctx: ctx}
+		defer func() {
+			thrownPanic := recover()
+			stream.submitCounts(sp, GetMetricHelperFromContext(ctx))
+			err = finishGRPCServerSpan(ctx, sp, err, thrownPanic)
+		}()
+
+		return handler(srv, stream)
+	}
+}
+
+type messageCounter struct {
+	received int64
+	sent     int64
+}
+
+func (m *messageCounter) submitCounts(sp trace.Span, mh *MetricHelper) {
+	base := sp.(*wrappedSpan).cfg.MetricNameBase
+	mh.AddCount(base+"MessagesReceived", float64(m.received))
+	mh.AddCount(base+"MessagesSent", float64(m.sent))
+	sp.SetAttributes(messagesReceivedKey.Int64(m.received), messagesSentKey.Int64(m.sent))
+}
+
+var (
+	messagesReceivedKey = attribute.Key("rpc.messages.received")
+	messagesSentKey     = attribute.Key("rpc.messages.sent")
+)
+
+// countingServerStream counts the messages and replaces the stream context
+type countingServerStream struct {
+	grpc.ServerStream
+	messageCounter
+	ctx context.Context
+}
+
+func (s *countingServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *countingServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent++
+	}
+	return err
+}
+
+func (s *countingServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received++
+	}
+	return err
+}
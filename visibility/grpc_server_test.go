@@ -0,0 +1,199 @@
+package visibility
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+	"testing"
+)
+
+func TestGRPCServerInterceptor(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, rec := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	mc := runMockCollectorWithOptions(t, grpc.ChainUnaryInterceptor(NewUnaryServerInterceptor(obs)))
+	t.Cleanup(mc.Stop)
+
+	conn, err := grpc.Dial(mc.endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// Pretend that the call comes from another traced service
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x11, 0x22},
+		SpanID:     trace.SpanID{0x33},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := MarkAsCanary(trace.ContextWithRemoteSpanContext(context.Background(), parent), true)
+	md := metadata.MD{}
+	DefaultPropagator.Inject(ctx, metadataCarrier(md))
+	ctx = metadata.NewOutgoingContext(context.Background(), md)
+
+	_, err = collectortracepb.NewTraceServiceClient(conn).Export(ctx,
+		&collectortracepb.ExportTraceServiceRequest{})
+	assert.NoError(t, err)
+
+	values := rec.Get()
+	assert.Equal(t, 1, len(values.Spans))
+	span := values.Spans[0]
+	assert.Equal(t, "opentelemetry.proto.collector.trace.v1.TraceService/Export", span.Name())
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind())
+	assert.Equal(t, parent.SpanID(), span.Parent().SpanID())
+
+	attrs := attribute.NewSet(span.Attributes()...)
+	method, _ := attrs.Value("rpc.method")
+	assert.Equal(t, "Export", method.AsString())
+	code, _ := attrs.Value("rpc.grpc.status_code")
+	assert.Equal(t, int64(0), code.AsInt64())
+	canary, _ := attrs.Value(CanaryAttributeName)
+	assert.True(t, canary.AsBool())
+
+	assert.Equal(t, 1., values.Metrics["GRPCServerSuccess"])
+	assert.Empty(t, sink.String())
+}
+
+func TestGRPCServerInterceptorOutcomes(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, rec := NewDeltaRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	interceptor := NewUnaryServerInterceptor(obs)
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Svc/Call"}
+
+	call := func(handler grpc.UnaryHandler) (interface{}, Record, error) {
+		resp, err := interceptor(context.Background(), "req", info, handler)
+		return resp, rec.Get(), err
+	}
+
+	resp, values, err := call(func(ctx context.Context, req interface{}) (interface{}, error) {
+		logging.L(ctx).Info("Calling")
+		return "resp", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "resp", resp)
+	assert.Equal(t, 1., values.Metrics["GRPCServerSuccess"])
+	assert.True(t, strings.Contains(sink.String(), `"logger":"test.Svc/Call","msg":"Calling"`))
+
+	_, values, err = call(func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "no such thing")
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, 1., values.Metrics["GRPCServerError"])
+	assert.Equal(t, 0., values.Metrics["GRPCServerFault"])
+
+	_, values, err = call(func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Unavailable, "overloaded")
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, 0., values.Metrics["GRPCServerError"])
+	assert.Equal(t, 1., values.Metrics["GRPCServerFault"])
+
+	resp, values, err = call(func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("the handler is broken")
+	})
+	assert.Nil(t, resp)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, "panic: the handler is broken", status.Convert(err).Message())
+	assert.Equal(t, 1., values.Metrics["GRPCServerFault"])
+	assert.Equal(t, otelcodes.Error, values.Spans[0].Status().Code)
+	assert.True(t, strings.Contains(sink.String(), `"msg":"Panic in the gRPC handler"`))
+	assert.True(t, strings.Contains(sink.String(), `"panic":"the handler is broken"`))
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	incoming int
+}
+
+func (f *fakeServerStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeServerStream) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (f *fakeServerStream) SendMsg(interface{}) error {
+	return nil
+}
+
+func (f *fakeServerStream) RecvMsg(interface{}) error {
+	if f.incoming == 0 {
+		return status.Error(codes.Canceled, "no more messages")
+	}
+	f.incoming--
+	return nil
+}
+
+func TestGRPCStreamServerInterceptor(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	interceptor := NewStreamServerInterceptor(obs)
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Svc/Stream", IsClientStream: true}
+
+	stream := &fakeServerStream{ctx: context.Background(), incoming: 3}
+	err := interceptor(nil, stream, info, func(srv interface{}, ss grpc.ServerStream) error {
+		// The handler sees the span
+		assert.True(t, trace.SpanFromContext(ss.Context()).SpanContext().IsValid())
+		for ss.RecvMsg(nil) == nil {
+			assert.NoError(t, ss.SendMsg("reply"))
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	values := rec.Get()
+	assert.Equal(t, 1., values.Metrics["GRPCServerSuccess"])
+	assert.Equal(t, 3., values.Metrics["GRPCServerMessagesReceived"])
+	assert.Equal(t, 3., values.Metrics["GRPCServerMessagesSent"])
+
+	err = interceptor(nil, &fakeServerStream{ctx: context.Background()}, info,
+		func(srv interface{}, ss grpc.ServerStream) error {
+			panic("stream is broken")
+		})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, 1., rec.Get().Metrics["GRPCServerFault"])
+}
+
+func TestGRPCMetricAttributes(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	server := NewUnaryServerInterceptor(obs)
+	_, err := server(context.Background(), "req", &grpc.UnaryServerInfo{FullMethod: "/test.Svc/Call"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return "resp", nil
+		})
+	assert.NoError(t, err)
+
+	client := NewUnaryClientInterceptor(obs, WithGRPCMetricNameBase("Backend"))
+	err = client(context.Background(), "/test.Svc/Call", "req", nil, nil,
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+			opts ...grpc.CallOption) error {
+			return nil
+		})
+	assert.NoError(t, err)
+
+	attrs := attribute.NewSet(semconv.RPCServiceKey.String("test.Svc"), semconv.RPCMethodKey.String("Call"))
+	expected := map[attribute.Distinct]float64{attrs.Equivalent(): 1}
+	assert.Equal(t, expected, collectSumSets(t, reader, "GRPCServerSuccess"))
+	assert.Equal(t, expected, collectSumSets(t, reader, "BackendSuccess"))
+}
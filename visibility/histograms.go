@@ -0,0 +1,92 @@
+package visibility
+
+import (
+	"fmt"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/aggregation"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// HistogramBuckets maps the metric names to the bucket boundaries of the histograms recorded
+// by MetricHelper.Record. The names can contain the "*" and "?" wildcards. The histograms
+// that are not listed use the SDK default boundaries, suitable for milliseconds.
+type HistogramBuckets map[string][]float64
+
+// Validate checks that the boundaries are strictly increasing
+func (h HistogramBuckets) Validate() error {
+	for name, bounds := range h {
+		if name == "" {
+			return fmt.Errorf("empty histogram name")
+		}
+		for i := 1; i < len(bounds); i++ {
+			if bounds[i] <= bounds[i-1] {
+				return fmt.Errorf("histogram %s: the bucket boundaries must be increasing", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Views creates the metric view that applies the bucket boundaries, pass it to the
+// MeterProvider with sdkmetric.WithView. The names also match the histograms that have one
+// of the prefixes (e.g. the Observer's CanaryMetricPrefix) in front of them. The first
+// matching name wins for the overlapping wildcards, in the sorted order.
+func (h HistogramBuckets) Views(prefixes ...string) ([]sdkmetric.View, error) {
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+	if len(h) == 0 {
+		return nil, nil
+	}
+
+	// Keep the order stable
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type bucketRule struct {
+		re         *regexp.Regexp
+		boundaries []float64
+	}
+	rules := make([]bucketRule, 0, len(names))
+	for _, name := range names {
+		// The same wildcards as in sdkmetric.NewView
+		pattern := "^" + regexp.QuoteMeta(name) + "$"
+		pattern = strings.ReplaceAll(pattern, `\?`, ".")
+		pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+		rules = append(rules, bucketRule{
+			re:         regexp.MustCompile(pattern),
+			boundaries: append([]float64(nil), h[name]...),
+		})
+	}
+
+	view := func(inst sdkmetric.Instrument) (sdkmetric.Stream, bool) {
+		if inst.Kind != sdkmetric.InstrumentKindHistogram {
+			return sdkmetric.Stream{}, false
+		}
+		candidates := []string{inst.Name}
+		for _, p := range prefixes {
+			if p != "" && strings.HasPrefix(inst.Name, p) {
+				candidates = append(candidates, strings.TrimPrefix(inst.Name, p))
+			}
+		}
+		for _, r := range rules {
+			for _, c := range candidates {
+				if r.re.MatchString(c) {
+					return sdkmetric.Stream{
+						Name:        inst.Name,
+						Description: inst.Description,
+						Unit:        inst.Unit,
+						Aggregation: aggregation.ExplicitBucketHistogram{Boundaries: r.boundaries},
+					}, true
+				}
+			}
+		}
+		return sdkmetric.Stream{}, false
+	}
+	return []sdkmetric.View{view}, nil
+}
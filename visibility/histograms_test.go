@@ -0,0 +1,83 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestMetricHelperHistograms(t *testing.T) {
+	views, err := HistogramBuckets{"*Latency": {10, 100}}.Views()
+	assert.NoError(t, err)
+	obs, rec := NewRecordingObserver(zap.NewNop(), views...)
+	defer obs.Shutdown(context.Background())
+
+	sp, ctx := BeginNewSpan(context.Background(), obs, "Fetch", WithMetrics())
+	mh := GetMetricHelperFromContext(ctx)
+	mh.RecordDuration("FetchLatency", 5*time.Millisecond)
+	mh.RecordDuration("FetchLatency", 50*time.Millisecond)
+	mh.RecordDuration("FetchLatency", time.Second)
+	mh.Record(Named("FetchSize", UnitBytes), 300)
+	CleanupSpan(sp)
+
+	values := rec.Get()
+	assert.Equal(t, 1055., values.Metrics["FetchLatency"])
+
+	latency := values.Histograms["FetchLatency"][0]
+	assert.Equal(t, uint64(3), latency.Count)
+	assert.Equal(t, []float64{10, 100}, latency.Bounds)
+	assert.Equal(t, []uint64{1, 1, 1}, latency.BucketCounts)
+	// The metrics without the buckets configured use the default boundaries
+	assert.Equal(t, 15, len(values.Histograms["FetchSize"][0].Bounds))
+
+	// The accumulated values are exported to the span
+	var exported float64
+	for _, attr := range values.Spans[0].Attributes() {
+		if attr.Key == "FetchLatency" {
+			exported = attr.Value.AsFloat64()
+		}
+	}
+	assert.Equal(t, 1055., exported)
+
+	assert.Panics(t, func() {
+		mh.Record(Named("FetchSize", UnitMilliseconds), 1)
+	})
+	// The histograms can't be used as the counters, and the other way around
+	assert.Panics(t, func() {
+		mh.Add(Named("FetchSize", UnitBytes), 1)
+	})
+	assert.Panics(t, func() {
+		mh.InitCounts("FetchLatency")
+	})
+	assert.Panics(t, func() {
+		mh.RecordDuration("FetchSuccess", time.Second)
+	})
+	mh.InitCounts("FetchRetries")
+	assert.Panics(t, func() {
+		mh.Record(Named("FetchRetries", Dimensionless), 1)
+	})
+
+	_, err = HistogramBuckets{"Bad": {1, 1}}.Views()
+	assert.ErrorContains(t, err, "histogram Bad: the bucket boundaries must be increasing")
+}
+
+func TestHistogramBucketsWithPrefix(t *testing.T) {
+	views, err := HistogramBuckets{"FetchLatency": {10, 100}, "*Size": {1, 2}}.Views("canary.")
+	assert.NoError(t, err)
+	obs, rec := NewRecordingObserver(zap.NewNop(), views...)
+	defer obs.Shutdown(context.Background())
+	obs.CanaryMetricPrefix = "canary."
+
+	mh := obs.MakeMetricHelper(MarkAsCanary(context.Background(), true))
+	mh.RecordDuration("FetchLatency", 5*time.Millisecond)
+	mh.Record(Named("FetchSize", UnitBytes), 3)
+	mh.RecordDuration("OtherLatency", 5*time.Millisecond)
+	mh.Close()
+
+	values := rec.Get()
+	assert.Equal(t, []float64{10, 100}, values.Histograms["canary.FetchLatency"][0].Bounds)
+	assert.Equal(t, []float64{1, 2}, values.Histograms["canary.FetchSize"][0].Bounds)
+	assert.Equal(t, 15, len(values.Histograms["canary.OtherLatency"][0].Bounds))
+}
@@ -0,0 +1,226 @@
+package visibility
+
+import (
+	"crypto/tls"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/atomic"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// HTTPClientConfig is the configuration of the instrumented RoundTripper
+type HTTPClientConfig struct {
+	// The base for the metric names, "HTTPClient" by default
+	MetricNameBase string
+
+	// Record the connection phases (DNS, connect, TLS) as the span events
+	TraceConnection bool
+
+	// Additional options for the client spans
+	SpanOptions []BeginSpanOption
+}
+
+// HTTPClientOption is used to customize the instrumented RoundTripper
+type HTTPClientOption func(cfg *HTTPClientConfig)
+
+// WithClientMetricNameBase overrides the "HTTPClient" metric name base
+func WithClientMetricNameBase(base string) HTTPClientOption {
+	return func(cfg *HTTPClientConfig) {
+		cfg.MetricNameBase = base
+	}
+}
+
+// WithConnectionTrace records the DNS, connect and TLS phases as the span events
+func WithConnectionTrace() HTTPClientOption {
+	return func(cfg *HTTPClientConfig) {
+		cfg.TraceConnection = true
+	}
+}
+
+// WithClientSpanOptions adds the options for the client spans
+func WithClientSpanOptions(options ...BeginSpanOption) HTTPClientOption {
+	return func(cfg *HTTPClientConfig) {
+		cfg.SpanOptions = append(cfg.SpanOptions, options...)
+	}
+}
+
+// NewRoundTripper wraps the RoundTripper (http.DefaultTransport if nil) to run each
+// request inside a client span started by BeginNewSpan. The trace context and baggage
+// are injected into the request headers. The span ends once the response body is read
+// to the end or closed, so the body must be closed as usual.
+//
+// The following metrics are submitted with the "net.peer.name" attribute set to the
+// request host:
+// <Base>Success=1 in case the server responds with a non-error status
+// <Base>Error=1 in case the request fails or the server responds with 4xx/5xx
+// <Base>Fault=1 in case the wrapped RoundTripper panics
+// <Base>Latency - the histogram of the times until the response headers are received, in milliseconds
+// <Base>ResponseSize - the number of the response body bytes read
+func NewRoundTripper(obs *Observer, next http.RoundTripper, options ...HTTPClientOption) http.RoundTripper {
+	cfg := HTTPClientConfig{
+		MetricNameBase: "HTTPClient",
+	}
+	for _, o := range options {
+		o(&cfg)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return &instrumentedRoundTripper{obs: obs, next: next, cfg: cfg}
+}
+
+type instrumentedRoundTripper struct {
+	obs  *Observer
+	next http.RoundTripper
+	cfg  HTTPClientConfig
+}
+
+func (t *instrumentedRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	spanOpts := []BeginSpanOption{
+		WithMetrics(),
+		WithCustomMetricNameBase(t.cfg.MetricNameBase),
+		WithMetricAttributes(semconv.NetPeerNameKey.String(r.URL.Hostname())),
+		WithSpanStartOptions(
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(r)...),
+		),
+	}
+	spanOpts = append(spanOpts, t.cfg.SpanOptions...)
+
+	sp, ctx := BeginNewSpan(r.Context(), t.obs, "HTTP "+r.Method, spanOpts...)
+	bodyOwnsSpan := false
+	defer func() {
+		if bodyOwnsSpan {
+			return
+		}
+		// recover() only works in the deferred function itself
+		thrownPanic := recover()
+		doCleanupWithErr(sp, nil, thrownPanic)
+		if thrownPanic != nil {
+			panic(thrownPanic)
+		}
+	}()
+
+	if t.cfg.TraceConnection {
+		ctx = httptrace.WithClientTrace(ctx, newSpanClientTrace(sp))
+	}
+
+	// RoundTripper must not modify the original request
+	r = r.Clone(ctx)
+	t.obs.textMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+	if requestID := RequestIDFromContext(ctx); requestID != "" && r.Header.Get(RequestIDHeader) == "" {
+		// For the servers that don't understand the baggage
+		r.Header.Set(RequestIDHeader, requestID)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	GetMetricHelperFromContext(ctx).RecordDuration(t.cfg.MetricNameBase+"Latency", time.Since(start))
+
+	if err != nil {
+		sp.RecordError(err)
+		sp.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	sp.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(resp.StatusCode)...)
+	if resp.StatusCode >= 400 {
+		sp.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(resp.StatusCode, trace.SpanKindClient))
+	}
+
+	body := &responseBody{sp: sp, mh: GetMetricHelperFromContext(ctx), base: t.cfg.MetricNameBase}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		// There's nothing to read
+		body.finish(nil)
+	} else {
+		body.ReadCloser = resp.Body
+		resp.Body = body
+	}
+	bodyOwnsSpan = true
+
+	return resp, nil
+}
+
+// responseBody counts the bytes read from the response body, and ends the client span
+// once the body is read to the end or closed
+type responseBody struct {
+	io.ReadCloser
+	sp   trace.Span
+	mh   *MetricHelper
+	base string
+
+	// Close can be called concurrently with Read to abort it
+	read atomic.Int64
+	done sync.Once
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read.Add(int64(n))
+	if err == io.EOF {
+		b.finish(nil)
+	} else if err != nil {
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish(nil)
+	return err
+}
+
+func (b *responseBody) finish(readErr error) {
+	b.done.Do(func() {
+		size := b.read.Load()
+		b.sp.SetAttributes(semconv.HTTPResponseContentLengthKey.Int64(size))
+		b.mh.Add(Named(b.base+"ResponseSize", UnitBytes), float64(size))
+		doCleanupWithErr(b.sp, readErr, nil)
+	})
+}
+
+func newSpanClientTrace(sp trace.Span) *httptrace.ClientTrace {
+	withErr := func(name string, err error) {
+		if err != nil {
+			sp.AddEvent(name, trace.WithAttributes(attribute.String("error", err.Error())))
+		} else {
+			sp.AddEvent(name)
+		}
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			sp.AddEvent("dns.start", trace.WithAttributes(attribute.String("host", info.Host)))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			withErr("dns.done", info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			sp.AddEvent("connect.start", trace.WithAttributes(attribute.String("addr", addr)))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			withErr("connect.done", err)
+		},
+		TLSHandshakeStart: func() {
+			sp.AddEvent("tls.start")
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			withErr("tls.done", err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			sp.AddEvent("got_conn", trace.WithAttributes(attribute.Bool("reused", info.Reused)))
+		},
+		GotFirstResponseByte: func() {
+			sp.AddEvent("first_byte")
+		},
+	}
+}
@@ -0,0 +1,127 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoundTripper(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	// The server is instrumented too, so we can check the propagation
+	server := httptest.NewServer(NewHTTPMiddleware(obs)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.True(t, IsCanaryRequest(r.Context()))
+			if r.URL.Path == "/missing" {
+				http.NotFound(w, r)
+				return
+			}
+			if r.URL.Path == "/stream" {
+				// The response is chunked, its length is not known in advance
+				_, _ = w.Write([]byte("hello, "))
+				w.(http.Flusher).Flush()
+				_, _ = w.Write([]byte("world"))
+				return
+			}
+			_, _ = w.Write([]byte("hello"))
+		})))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewRoundTripper(obs, nil, WithConnectionTrace())}
+
+	ctx := MarkAsCanary(context.Background(), true)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/hello", nil)
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	_ = resp.Body.Close()
+	// The original request is not modified
+	assert.Empty(t, req.Header.Get("traceparent"))
+
+	values := rec.Get()
+	assert.Equal(t, 2, len(values.Spans))
+	serverSpan, clientSpan := values.Spans[0], values.Spans[1]
+	assert.Equal(t, "HTTP GET", clientSpan.Name())
+	assert.Equal(t, trace.SpanKindClient, clientSpan.SpanKind())
+	assert.Equal(t, clientSpan.SpanContext().SpanID(), serverSpan.Parent().SpanID())
+
+	attrs := attribute.NewSet(clientSpan.Attributes()...)
+	status, _ := attrs.Value("http.status_code")
+	assert.Equal(t, int64(200), status.AsInt64())
+	size, _ := attrs.Value("http.response_content_length")
+	assert.Equal(t, int64(5), size.AsInt64())
+
+	var events []string
+	for _, e := range clientSpan.Events() {
+		events = append(events, e.Name)
+	}
+	assert.Contains(t, events, "connect.start")
+	assert.Contains(t, events, "got_conn")
+	assert.Contains(t, events, "first_byte")
+
+	assert.Equal(t, 1., values.Metrics["HTTPClientSuccess"])
+	assert.Equal(t, 0., values.Metrics["HTTPClientError"])
+	assert.Equal(t, 1, len(values.Histograms["HTTPClientLatency"]))
+	assert.Equal(t, uint64(1), values.Histograms["HTTPClientLatency"][0].Count)
+	assert.Equal(t, 5., values.Metrics["HTTPClientResponseSize"])
+
+	// The span ends once the body is read, the size is known even without the Content-Length
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/stream", nil)
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, 1, len(rec.Get().Spans))
+	_, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	values = rec.Get()
+	assert.Equal(t, 1, len(values.Spans))
+	attrs = attribute.NewSet(values.Spans[0].Attributes()...)
+	size, _ = attrs.Value("http.response_content_length")
+	assert.Equal(t, int64(12), size.AsInt64())
+	// The counters are cumulative
+	assert.Equal(t, 5.+12., values.Metrics["HTTPClientResponseSize"])
+	_ = resp.Body.Close()
+
+	// The 4xx responses are errors
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/missing", nil)
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+
+	values = rec.Get()
+	assert.Equal(t, 1., values.Metrics["HTTPClientError"])
+	assert.Equal(t, codes.Error, values.Spans[1].Status().Code)
+}
+
+type failingRoundTripper struct{}
+
+func (f failingRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+func TestRoundTripperFailure(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	client := &http.Client{Transport: NewRoundTripper(obs, failingRoundTripper{},
+		WithClientMetricNameBase("Billing"))}
+	_, err := client.Get("http://billing.local/invoices")
+	assert.ErrorContains(t, err, "connection refused")
+
+	values := rec.Get()
+	assert.Equal(t, 1., values.Metrics["BillingError"])
+	assert.Equal(t, "connection refused", values.Spans[0].Status().Description)
+}
@@ -0,0 +1,282 @@
+package visibility
+
+import (
+	"bufio"
+	"fmt"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultPropagator is used by the HTTP and gRPC instrumentation if the Observer
+// doesn't have its own Propagator. The canary flag is carried in the baggage.
+var DefaultPropagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{}, propagation.Baggage{})
+
+func (o *Observer) textMapPropagator() propagation.TextMapPropagator {
+	if o.Propagator != nil {
+		return o.Propagator
+	}
+	return DefaultPropagator
+}
+
+// HTTPServerConfig is the configuration of the HTTP server middleware
+type HTTPServerConfig struct {
+	// The base for the metric names, "HTTPServer" by default
+	MetricNameBase string
+
+	// ServerName is reported as the http.server_name attribute, the Host header is used if empty
+	ServerName string
+
+	// RouteFunc returns the route template for the request (e.g. "GET /users/{id}"),
+	// it's used as the span name and the http.route attribute of the metrics. It must
+	// not return the raw URL path, the metric cardinality will explode otherwise.
+	RouteFunc func(r *http.Request) string
+
+	// Additional options for the server spans
+	SpanOptions []BeginSpanOption
+
+	// The access log for the requests, optional
+	AccessLog *AccessLogger
+}
+
+// HTTPServerOption is used to customize the HTTP server middleware
+type HTTPServerOption func(cfg *HTTPServerConfig)
+
+// WithServerMetricNameBase overrides the "HTTPServer" metric name base
+func WithServerMetricNameBase(base string) HTTPServerOption {
+	return func(cfg *HTTPServerConfig) {
+		cfg.MetricNameBase = base
+	}
+}
+
+// WithRouteFunc sets the function that returns the route template for the request
+func WithRouteFunc(fn func(r *http.Request) string) HTTPServerOption {
+	return func(cfg *HTTPServerConfig) {
+		cfg.RouteFunc = fn
+	}
+}
+
+// WithServerName sets the http.server_name attribute
+func WithServerName(name string) HTTPServerOption {
+	return func(cfg *HTTPServerConfig) {
+		cfg.ServerName = name
+	}
+}
+
+// WithServerSpanOptions adds the options for the server spans, e.g. WithCustomMetricPrefix
+func WithServerSpanOptions(options ...BeginSpanOption) HTTPServerOption {
+	return func(cfg *HTTPServerConfig) {
+		cfg.SpanOptions = append(cfg.SpanOptions, options...)
+	}
+}
+
+// WithAccessLog writes a line to the access log at the end of each request
+func WithAccessLog(accessLog *AccessLogger) HTTPServerOption {
+	return func(cfg *HTTPServerConfig) {
+		cfg.AccessLog = accessLog
+	}
+}
+
+// DefaultRouteFunc names the requests only by their method, because the raw URL paths
+// can not be safely used as metric attributes
+func DefaultRouteFunc(r *http.Request) string {
+	return "HTTP " + metricHTTPMethod(r.Method)
+}
+
+// metricHTTPMethod replaces the non-standard methods with "_OTHER", the clients can send
+// anything as the method
+func metricHTTPMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "_OTHER"
+}
+
+// NewHTTPMiddleware creates the middleware that runs each request inside a server span
+// started by BeginNewSpan with metrics. The incoming trace context and baggage (including
+// the canary flag) are extracted from the headers, and the request context gets the span
+// and its logger.
+//
+// The request ID is taken from the X-Request-Id header or the baggage, or generated if
+// the client hasn't sent it. It's echoed in the X-Request-Id response header.
+//
+// The following metrics are submitted for each request with the "http.method" and "http.route"
+// attributes, in addition to the usual <Base>Success/Error/Fault counts:
+// <Base>Duration - the histogram of the request durations in milliseconds
+// <Base>ResponseSize - the size of the response body
+//
+// The 5xx responses and panics are counted as a Fault, the panics are re-thrown
+// after the span is finished.
+func NewHTTPMiddleware(obs *Observer, options ...HTTPServerOption) func(http.Handler) http.Handler {
+	cfg := HTTPServerConfig{
+		MetricNameBase: "HTTPServer",
+		RouteFunc:      DefaultRouteFunc,
+	}
+	for _, o := range options {
+		o(&cfg)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveInstrumented(obs, &cfg, next, w, r)
+		})
+	}
+}
+
+func serveInstrumented(obs *Observer, cfg *HTTPServerConfig, next http.Handler,
+	w http.ResponseWriter, r *http.Request) {
+
+	ctx := obs.textMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	// Echo the request ID, so that the clients can refer to it
+	requestID := incomingRequestID(ctx, r.Header.Get(RequestIDHeader))
+	ctx = obs.ContextWithRequestID(ctx, requestID)
+	w.Header().Set(RequestIDHeader, requestID)
+
+	route := cfg.RouteFunc(r)
+	serverName := cfg.ServerName
+	if serverName == "" {
+		serverName = r.Host
+	}
+
+	spanOpts := []BeginSpanOption{
+		WithMetrics(),
+		WithCustomMetricNameBase(cfg.MetricNameBase),
+		WithMetricAttributes(semconv.HTTPMethodKey.String(metricHTTPMethod(r.Method)),
+			semconv.HTTPRouteKey.String(route)),
+		WithSpanStartOptions(
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(serverName, route, r)...),
+		),
+	}
+	spanOpts = append(spanOpts, cfg.SpanOptions...)
+
+	sp, ctx := BeginNewSpan(ctx, obs, route, spanOpts...)
+	// CleanupSpan must be deferred directly to be able to catch the panics
+	defer CleanupSpan(sp)
+
+	rw := &statusRecordingWriter{ResponseWriter: w}
+	start := time.Now()
+
+	// This runs before CleanupSpan, even if the handler panics
+	defer func() {
+		elapsed := time.Since(start)
+		mh := GetMetricHelperFromContext(ctx)
+		base := sp.(*wrappedSpan).cfg.MetricNameBase
+		mh.RecordDuration(base+"Duration", elapsed)
+		mh.Add(Named(base+"ResponseSize", UnitBytes), float64(rw.written))
+
+		// If nothing has been written, a panic is about to be counted as a Fault
+		if rw.wroteHeader {
+			sp.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(rw.status)...)
+			sp.SetAttributes(semconv.HTTPResponseContentLengthKey.Int64(rw.written))
+			if rw.status >= 500 {
+				sp.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(rw.status, trace.SpanKindServer))
+				MarkAsFault(sp)
+			}
+		}
+
+		if cfg.AccessLog != nil {
+			cfg.AccessLog.Log(ctx, sp, AccessLogEntry{
+				Method:    r.Method,
+				Route:     route,
+				Status:    rw.status,
+				Latency:   elapsed,
+				Bytes:     rw.written,
+				ClientIP:  cfg.AccessLog.clientIP(r),
+				UserAgent: r.UserAgent(),
+				Failed:    !rw.wroteHeader,
+			})
+		}
+	}()
+
+	next.ServeHTTP(rw, r.WithContext(ctx))
+
+	if !rw.wroteHeader {
+		// The handler has returned without writing anything, net/http sends 200 in this case
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// statusRecordingWriter remembers the response status and counts the written bytes
+type statusRecordingWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+	status      int
+	written     int64
+}
+
+func (s *statusRecordingWriter) WriteHeader(statusCode int) {
+	if !s.wroteHeader {
+		s.wroteHeader = true
+		s.status = statusCode
+	}
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (s *statusRecordingWriter) Write(data []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	n, err := s.ResponseWriter.Write(data)
+	s.written += int64(n)
+	return n, err
+}
+
+// Flush is needed for the streaming responses
+func (s *statusRecordingWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		if !s.wroteHeader {
+			s.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// ReadFrom is used by io.Copy, e.g. in http.ServeContent
+func (s *statusRecordingWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	rf, ok := s.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		// Hide our ReadFrom from io.Copy, the bytes are counted by Write
+		return io.Copy(struct{ io.Writer }{s}, src)
+	}
+	n, err := rf.ReadFrom(src)
+	s.written += n
+	return n, err
+}
+
+// Push is needed for the HTTP/2 server push
+func (s *statusRecordingWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := s.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap is used by http.ResponseController to get to the original writer
+func (s *statusRecordingWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Hijack is needed for WebSockets
+func (s *statusRecordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	// The connection is taken over, so there won't be a status
+	s.wroteHeader = true
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
@@ -0,0 +1,153 @@
+package visibility
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func routeByPath(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, rec := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	handler := NewHTTPMiddleware(obs, WithRouteFunc(routeByPath))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.True(t, IsCanaryRequest(r.Context()))
+			logging.L(r.Context()).Info("Handling")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("hello"))
+		}))
+
+	// Pretend that the request comes from another traced service
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x11, 0x22},
+		SpanID:     trace.SpanID{0x33},
+		TraceFlags: trace.FlagsSampled,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/items", nil)
+	ctx := MarkAsCanary(trace.ContextWithRemoteSpanContext(context.Background(), parent), true)
+	DefaultPropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	values := rec.Get()
+	assert.Equal(t, 1, len(values.Spans))
+	span := values.Spans[0]
+	assert.Equal(t, "POST /items", span.Name())
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind())
+	assert.Equal(t, parent.TraceID(), span.Parent().TraceID())
+	assert.Equal(t, parent.SpanID(), span.Parent().SpanID())
+
+	attrs := attribute.NewSet(span.Attributes()...)
+	status, _ := attrs.Value("http.status_code")
+	assert.Equal(t, int64(201), status.AsInt64())
+	size, _ := attrs.Value("http.response_content_length")
+	assert.Equal(t, int64(5), size.AsInt64())
+	canary, _ := attrs.Value(CanaryAttributeName)
+	assert.True(t, canary.AsBool())
+
+	assert.Equal(t, 1., values.Metrics["HTTPServerSuccess"])
+	assert.Equal(t, 0., values.Metrics["HTTPServerFault"])
+	assert.Equal(t, 5., values.Metrics["HTTPServerResponseSize"])
+	assert.Equal(t, 1, len(values.Histograms["HTTPServerDuration"]))
+	assert.Equal(t, uint64(1), values.Histograms["HTTPServerDuration"][0].Count)
+
+	assert.True(t, strings.Contains(sink.String(), `"logger":"POST /items","msg":"Handling"`))
+}
+
+func TestHTTPMiddlewareWriterInterfaces(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	resp := httptest.NewRecorder()
+	handler := NewHTTPMiddleware(obs, WithRouteFunc(routeByPath))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+			assert.True(t, ok)
+			assert.Equal(t, resp, unwrapper.Unwrap())
+
+			// The recorder doesn't support the server push
+			assert.ErrorIs(t, w.(http.Pusher).Push("/style.css", nil), http.ErrNotSupported)
+
+			n, err := w.(io.ReaderFrom).ReadFrom(strings.NewReader("streamed"))
+			assert.NoError(t, err)
+			assert.Equal(t, int64(8), n)
+		}))
+
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/file", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "streamed", resp.Body.String())
+
+	values := rec.Get()
+	assert.Equal(t, 8., values.Metrics["HTTPServerResponseSize"])
+}
+
+func TestHTTPMiddlewareFaults(t *testing.T) {
+	_, logger := logging.NewMemorySinkLogger()
+	obs, rec := NewDeltaRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	middleware := NewHTTPMiddleware(obs)
+
+	// The 4xx responses are the caller's problem
+	notFound := middleware(http.NotFoundHandler())
+	notFound.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	values := rec.Get()
+	assert.Equal(t, 1., values.Metrics["HTTPServerSuccess"])
+	assert.Equal(t, codes.Unset, values.Spans[0].Status().Code)
+
+	broken := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusServiceUnavailable)
+	}))
+	broken.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	values = rec.Get()
+	assert.Equal(t, 1., values.Metrics["HTTPServerFault"])
+	assert.Equal(t, 0., values.Metrics["HTTPServerSuccess"])
+	assert.Equal(t, codes.Error, values.Spans[0].Status().Code)
+
+	panicky := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler is broken")
+	}))
+	assert.PanicsWithValue(t, "handler is broken", func() {
+		panicky.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/", nil))
+	})
+	values = rec.Get()
+	assert.Equal(t, 1., values.Metrics["HTTPServerFault"])
+	assert.Equal(t, codes.Error, values.Spans[0].Status().Code)
+}
+
+func TestHTTPMiddlewareMetricAttributes(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	handler := NewHTTPMiddleware(obs)(http.NotFoundHandler())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	// The clients can send any method, they are not used as the attribute values as is
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/pot", nil))
+
+	get := attribute.NewSet(semconv.HTTPMethodKey.String("GET"), semconv.HTTPRouteKey.String("HTTP GET"))
+	other := attribute.NewSet(semconv.HTTPMethodKey.String("_OTHER"), semconv.HTTPRouteKey.String("HTTP _OTHER"))
+	assert.Equal(t, map[attribute.Distinct]float64{get.Equivalent(): 1, other.Equivalent(): 1},
+		collectSumSets(t, reader, "HTTPServerSuccess"))
+}
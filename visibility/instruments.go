@@ -0,0 +1,80 @@
+package visibility
+
+import (
+	"github.com/Cyberax/argus-vision/utils"
+	"go.opentelemetry.io/otel/metric"
+	"reflect"
+	"sync"
+)
+
+type instrumentKind int
+
+const (
+	instrumentUpDownCounter instrumentKind = iota
+	instrumentCounter
+	instrumentHistogram
+)
+
+type instrumentKey struct {
+	meter metric.Meter
+	kind  instrumentKind
+	name  string
+	unit  string
+}
+
+// instrumentRegistry caches the instruments used by the MetricHelpers. Creating an instrument
+// in the SDK takes a global lock and allocates, and the helpers do it for every measurement.
+// Each Observer owns a registry (shared with its scoped children) and clears it in Shutdown.
+// The nil registry doesn't cache anything, and neither do the meters that can't be used
+// as the map keys.
+type instrumentRegistry struct {
+	instruments sync.Map
+}
+
+func cachedInstrument[T any](r *instrumentRegistry, key instrumentKey, create func() (T, error)) T {
+	if r == nil || !reflect.TypeOf(key.meter).Comparable() {
+		inst, err := create()
+		utils.PanicIfErr(err)
+		return inst
+	}
+	if inst, ok := r.instruments.Load(key); ok {
+		return inst.(T)
+	}
+	inst, err := create()
+	utils.PanicIfErr(err)
+	// Another goroutine might have won the race, the SDK returns the same instrument anyway
+	actual, _ := r.instruments.LoadOrStore(key, inst)
+	return actual.(T)
+}
+
+// clear drops the cached instruments, so that the meters they belong to can be collected
+func (r *instrumentRegistry) clear() {
+	if r == nil {
+		return
+	}
+	r.instruments.Range(func(key, _ any) bool {
+		r.instruments.Delete(key)
+		return true
+	})
+}
+
+func (r *instrumentRegistry) upDownCounter(meter metric.Meter, name, unit string) metric.Float64UpDownCounter {
+	return cachedInstrument(r, instrumentKey{meter, instrumentUpDownCounter, name, unit},
+		func() (metric.Float64UpDownCounter, error) {
+			return meter.Float64UpDownCounter(name, metric.WithUnit(unit))
+		})
+}
+
+func (r *instrumentRegistry) counter(meter metric.Meter, name, unit string) metric.Float64Counter {
+	return cachedInstrument(r, instrumentKey{meter, instrumentCounter, name, unit},
+		func() (metric.Float64Counter, error) {
+			return meter.Float64Counter(name, metric.WithUnit(unit))
+		})
+}
+
+func (r *instrumentRegistry) histogram(meter metric.Meter, name, unit string) metric.Float64Histogram {
+	return cachedInstrument(r, instrumentKey{meter, instrumentHistogram, name, unit},
+		func() (metric.Float64Histogram, error) {
+			return meter.Float64Histogram(name, metric.WithUnit(unit))
+		})
+}
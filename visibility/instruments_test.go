@@ -0,0 +1,135 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestInstrumentRegistry(t *testing.T) {
+	registry := &instrumentRegistry{}
+	meter := sdkmetric.NewMeterProvider().Meter("test")
+	other := sdkmetric.NewMeterProvider().Meter("test")
+
+	c1 := registry.upDownCounter(meter, "Requests", Dimensionless)
+	assert.Same(t, c1, registry.upDownCounter(meter, "Requests", Dimensionless))
+	assert.NotSame(t, c1, registry.upDownCounter(other, "Requests", Dimensionless))
+	assert.NotSame(t, c1, registry.upDownCounter(meter, "Requests", UnitBytes))
+	assert.NotNil(t, registry.counter(meter, "Requests", Dimensionless))
+	assert.NotNil(t, registry.histogram(meter, "Requests", Dimensionless))
+
+	// The cached instruments are dropped
+	registry.clear()
+	assert.NotSame(t, c1, registry.upDownCounter(meter, "Requests", Dimensionless))
+
+	// The meters that can't be the map keys, and the nil registry are not cached
+	odd := uncomparableMeter{Meter: meter}
+	assert.NotNil(t, registry.upDownCounter(odd, "Requests", Dimensionless))
+	var none *instrumentRegistry
+	assert.NotNil(t, none.counter(meter, "Requests", Dimensionless))
+	none.clear()
+}
+
+type uncomparableMeter struct {
+	metric.Meter
+	tags []string
+}
+
+func TestObserverInstruments(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	mh := obs.MakeMetricHelper(context.Background())
+	mh.AddCount("Requests", 1)
+	mh.Close()
+	assert.Equal(t, 1., rec.Get().Metrics["Requests"])
+
+	// The scoped children share the registry, and it's cleared when the observer is shut down
+	assert.Same(t, obs.instruments, obs.Scoped("child").instruments)
+	obs.Shutdown(context.Background())
+	count := 0
+	obs.instruments.instruments.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	assert.Zero(t, count)
+
+	// The helpers without the observer work without the cache
+	mh = NewMetricContext(context.Background(), sdkmetric.NewMeterProvider().Meter("test"))
+	mh.AddCount("Requests", 1)
+	mh.Close()
+}
+
+func benchmarkObserver(b *testing.B) *Observer {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewManualReader()))
+	obs.MetricAttributes = []attribute.KeyValue{attribute.String("service", "bench")}
+	b.Cleanup(func() { obs.Shutdown(context.Background()) })
+	return obs
+}
+
+const benchmarkAddsPerRequest = 20
+
+// BenchmarkMetricHelperUncached creates the instruments for every measurement, the way
+// MetricHelper used to do it
+func BenchmarkMetricHelperUncached(b *testing.B) {
+	obs := benchmarkObserver(b)
+	meter := obs.MeterController.Meter("bench")
+	attrs := metric.WithAttributes(obs.MetricAttributes...)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkAddsPerRequest; j++ {
+			counter, _ := meter.Float64UpDownCounter("Bytes", metric.WithUnit(UnitBytes))
+			counter.Add(context.Background(), 100, attrs)
+			num, _ := meter.Float64Counter("Bytes_num", metric.WithUnit(Dimensionless))
+			num.Add(context.Background(), 1, attrs)
+		}
+	}
+}
+
+func BenchmarkMetricHelperAdd(b *testing.B) {
+	obs := benchmarkObserver(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		mh := obs.MakeMetricHelper(context.Background())
+		for j := 0; j < benchmarkAddsPerRequest; j++ {
+			mh.Add(Named("Bytes", UnitBytes), 100)
+		}
+		mh.Close()
+	}
+}
+
+func BenchmarkMetricHelperPreAggregated(b *testing.B) {
+	obs := benchmarkObserver(b)
+	obs.PreAggregateMetrics = true
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		mh := obs.MakeMetricHelper(context.Background())
+		for j := 0; j < benchmarkAddsPerRequest; j++ {
+			mh.Add(Named("Bytes", UnitBytes), 100)
+		}
+		mh.Close()
+	}
+}
+
+func BenchmarkMetricHelperAddParallel(b *testing.B) {
+	obs := benchmarkObserver(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		mh := obs.MakeMetricHelper(context.Background())
+		for pb.Next() {
+			mh.Add(Named("Bytes", UnitBytes), 100)
+		}
+		mh.Close()
+	})
+}
@@ -0,0 +1,145 @@
+package logging
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// LevelControl allows to change the logging level at runtime, both globally and for
+// individual named loggers (see zap.Logger.Named). The per-name levels are hierarchical,
+// the level for "db" also applies to "db.queries" unless "db.queries" has its own level.
+type LevelControl struct {
+	global zap.AtomicLevel
+
+	mtx       sync.Mutex
+	overrides atomic.Value // map[string]zapcore.Level, replaced on each change
+}
+
+// NewLevelControl creates a LevelControl with the global level set to the
+// lowest level enabled by the logger
+func NewLevelControl(logger *zap.Logger) *LevelControl {
+	res := &LevelControl{global: zap.NewAtomicLevelAt(lowestEnabledLevel(logger.Core()))}
+	res.overrides.Store(map[string]zapcore.Level{})
+	return res
+}
+
+// WrapLogger returns the logger whose levels are controlled by this LevelControl
+func (l *LevelControl) WrapLogger(logger *zap.Logger) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &levelControlCore{Core: core, control: l}
+	}))
+}
+
+func lowestEnabledLevel(enabler zapcore.LevelEnabler) zapcore.Level {
+	for lvl := zapcore.DebugLevel; lvl < zapcore.FatalLevel; lvl++ {
+		if enabler.Enabled(lvl) {
+			return lvl
+		}
+	}
+	return zapcore.FatalLevel
+}
+
+// Level returns the global level
+func (l *LevelControl) Level() zapcore.Level {
+	return l.global.Level()
+}
+
+// SetLevel sets the global level
+func (l *LevelControl) SetLevel(lvl zapcore.Level) {
+	l.global.SetLevel(lvl)
+}
+
+// LoggerLevels returns the levels set for the individual loggers
+func (l *LevelControl) LoggerLevels() map[string]zapcore.Level {
+	cur := l.overrides.Load().(map[string]zapcore.Level)
+	res := make(map[string]zapcore.Level, len(cur))
+	for k, v := range cur {
+		res[k] = v
+	}
+	return res
+}
+
+// SetLoggerLevel sets the level for the named logger and all its children
+func (l *LevelControl) SetLoggerLevel(name string, lvl zapcore.Level) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	res := l.LoggerLevels()
+	res[name] = lvl
+	l.overrides.Store(res)
+}
+
+// ResetLoggerLevel makes the named logger use the level of its parent again
+func (l *LevelControl) ResetLoggerLevel(name string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	res := l.LoggerLevels()
+	delete(res, name)
+	l.overrides.Store(res)
+}
+
+// LevelFor returns the effective level for the named logger
+func (l *LevelControl) LevelFor(name string) zapcore.Level {
+	overrides := l.overrides.Load().(map[string]zapcore.Level)
+	for name != "" {
+		lvl, ok := overrides[name]
+		if ok {
+			return lvl
+		}
+		idx := strings.LastIndexByte(name, '.')
+		if idx < 0 {
+			break
+		}
+		name = name[:idx]
+	}
+	return l.global.Level()
+}
+
+// minLevel is the lowest level that is enabled for at least one logger
+func (l *LevelControl) minLevel() zapcore.Level {
+	res := l.global.Level()
+	for _, lvl := range l.overrides.Load().(map[string]zapcore.Level) {
+		if lvl < res {
+			res = lvl
+		}
+	}
+	return res
+}
+
+// levelControlCore filters the entries according to the LevelControl. It overrides the
+// level of the wrapped core, so it can enable the debug messages even if the original
+// logger was built with the info level.
+type levelControlCore struct {
+	zapcore.Core
+	control *LevelControl
+}
+
+func (c *levelControlCore) Enabled(level zapcore.Level) bool {
+	return level >= c.control.minLevel()
+}
+
+func (c *levelControlCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelControlCore{Core: c.Core.With(fields), control: c.control}
+}
+
+func (c *levelControlCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if entry.Level < c.control.LevelFor(entry.LoggerName) {
+		return checked
+	}
+	// Let the wrapped core do its own checks (e.g. sampling)
+	if c.Core.Enabled(entry.Level) {
+		return c.Core.Check(entry, checked)
+	}
+	// The level of the wrapped core is overridden, but it still has to accept the
+	// entry as if it had the lowest level that the core is enabled for
+	probe := entry
+	probe.Level = lowestEnabledLevel(c.Core)
+	if c.Core.Check(probe, nil) == nil {
+		return checked
+	}
+	return checked.AddCore(entry, c.Core)
+}
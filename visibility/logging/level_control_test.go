@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevelControl(t *testing.T) {
+	sink := &MemorySink{}
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = ""
+	// The original logger only logs the warnings
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(config), sink, zap.WarnLevel)
+
+	levels := NewLevelControl(zap.New(core))
+	assert.Equal(t, zapcore.WarnLevel, levels.Level())
+
+	logger := levels.WrapLogger(zap.New(core))
+	db := logger.Named("db")
+	queries := db.Named("queries")
+	http := logger.Named("http")
+
+	levels.SetLoggerLevel("db", zapcore.DebugLevel)
+	levels.SetLoggerLevel("db.queries", zapcore.ErrorLevel)
+	assert.Equal(t, zapcore.DebugLevel, levels.LevelFor("db.pool"))
+	assert.Equal(t, zapcore.WarnLevel, levels.LevelFor("dbx"))
+
+	db.Debug("db debug")
+	queries.Warn("queries warn")
+	queries.Error("queries error")
+	http.Info("http info")
+	http.Warn("http warn")
+
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	assert.Equal(t, []string{
+		`{"level":"debug","logger":"db","msg":"db debug"}`,
+		`{"level":"error","logger":"db.queries","msg":"queries error"}`,
+		`{"level":"warn","logger":"http","msg":"http warn"}`,
+	}, lines)
+
+	sink.Reset()
+	levels.ResetLoggerLevel("db")
+	levels.SetLevel(zapcore.InfoLevel)
+	db.Debug("db debug")
+	http.Info("http info")
+	assert.Equal(t, `{"level":"info","logger":"http","msg":"http info"}`, strings.TrimSpace(sink.String()))
+}
+
+func TestLevelControlKeepsSampling(t *testing.T) {
+	sink := &MemorySink{}
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = ""
+	// Only the first entry with the same message is logged each minute
+	core := zapcore.NewSamplerWithOptions(
+		zapcore.NewCore(zapcore.NewJSONEncoder(config), sink, zap.InfoLevel), time.Minute, 1, 0)
+
+	levels := NewLevelControl(zap.New(core))
+	logger := levels.WrapLogger(zap.New(core)).Named("db")
+	levels.SetLoggerLevel("db", zapcore.DebugLevel)
+
+	for i := 0; i < 3; i++ {
+		logger.Debug("debug")
+		logger.Info("info")
+	}
+
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	assert.Equal(t, []string{
+		`{"level":"debug","logger":"db","msg":"debug"}`,
+		`{"level":"info","logger":"db","msg":"info"}`,
+	}, lines)
+}
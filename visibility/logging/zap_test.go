@@ -55,3 +55,16 @@ func TestLevels(t *testing.T) {
     })
     assert.True(t, out == "")
 }
+
+func TestMemorySinkBufferMethods(t *testing.T) {
+    sink, logger := NewMemorySinkLogger()
+    logger.Info("hello")
+
+    line, err := sink.ReadString('\n')
+    assert.NoError(t, err)
+    assert.True(t, strings.Contains(line, `"msg":"hello"`))
+
+    _, _ = sink.WriteString("one two")
+    sink.Truncate(3)
+    assert.Equal(t, "one", sink.String())
+}
@@ -4,6 +4,7 @@ import (
     "bytes"
     "go.uber.org/zap"
     "go.uber.org/zap/zapcore"
+    "io"
     "sync"
 )
 
@@ -55,13 +56,144 @@ func ConfigureProdLogger() *zap.Logger {
     return logger
 }
 
-// MemorySink implements zap.Sink by writing all messages to a buffer.
+// MemorySink implements zap.Sink by writing all messages to a buffer. It has the methods of
+// bytes.Buffer, and it's safe to read it while the messages are being written (e.g. by the
+// finalizers).
 type MemorySink struct {
-    bytes.Buffer
+    mtx sync.Mutex
+    buf bytes.Buffer
 }
 func (s *MemorySink) Close() error { return nil }
 func (s *MemorySink) Sync() error  { return nil }
 
+func (s *MemorySink) Write(p []byte) (int, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.Write(p)
+}
+
+func (s *MemorySink) String() string {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.String()
+}
+
+// Bytes returns a copy of the written messages
+func (s *MemorySink) Bytes() []byte {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return append([]byte(nil), s.buf.Bytes()...)
+}
+
+func (s *MemorySink) Len() int {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.Len()
+}
+
+func (s *MemorySink) Reset() {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.buf.Reset()
+}
+
+func (s *MemorySink) Cap() int {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.Cap()
+}
+
+func (s *MemorySink) Grow(n int) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.buf.Grow(n)
+}
+
+func (s *MemorySink) Truncate(n int) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.buf.Truncate(n)
+}
+
+func (s *MemorySink) WriteString(str string) (int, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.WriteString(str)
+}
+
+func (s *MemorySink) WriteByte(c byte) error {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.WriteByte(c)
+}
+
+func (s *MemorySink) WriteRune(r rune) (int, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.WriteRune(r)
+}
+
+func (s *MemorySink) ReadFrom(r io.Reader) (int64, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.ReadFrom(r)
+}
+
+func (s *MemorySink) WriteTo(w io.Writer) (int64, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.WriteTo(w)
+}
+
+func (s *MemorySink) Read(p []byte) (int, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.Read(p)
+}
+
+func (s *MemorySink) ReadByte() (byte, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.ReadByte()
+}
+
+func (s *MemorySink) ReadRune() (rune, int, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.ReadRune()
+}
+
+func (s *MemorySink) ReadBytes(delim byte) ([]byte, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.ReadBytes(delim)
+}
+
+func (s *MemorySink) ReadString(delim byte) (string, error) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.ReadString(delim)
+}
+
+func (s *MemorySink) UnreadByte() error {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.UnreadByte()
+}
+
+func (s *MemorySink) UnreadRune() error {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.buf.UnreadRune()
+}
+
+// Next returns a copy of the next n bytes, see bytes.Buffer.Next
+func (s *MemorySink) Next(n int) []byte {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return append([]byte(nil), s.buf.Next(n)...)
+}
+
 func NewMemorySinkLogger() (*MemorySink, *zap.Logger) {
     sink := &MemorySink{}
     config := zap.NewProductionEncoderConfig()
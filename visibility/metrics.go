@@ -6,23 +6,76 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/atomic"
 	"sync"
+	"time"
 )
 
 const metricContextKey = "MetricContext"
 
+// MetricTagKey holds the metric dimensions in the mutable context. They are attached to all
+// the metrics submitted by the MetricHelpers created in this context. The tags from the outer
+// (forked) mutable contexts are inherited, the inner ones override them.
 var MetricTagKey = utils.NewMutableContextKey[map[string]string]("metricTags")
 
+// Tag adds the metric dimension to the MetricHelper in the context, or to the mutable context
+// if there is no helper (see MetricTagKey). The tags set inside a span started by BeginNewSpan
+// with metrics only apply to its own metrics and to the helpers created in its context.
+func Tag(ctx context.Context, key, value string) {
+	if m := TryGetMetricHelperFromContext(ctx); m != nil {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.scopeTags = withTag(m.scopeTags, key, value)
+		return
+	}
+
+	utils.EditMutableContextValue(ctx, MetricTagKey,
+		func(tags map[string]string, present bool) (map[string]string, bool) {
+			return withTag(tags, key, value), true
+		})
+}
+
+// withTag returns a copy of the tags with the new value, the maps can be shared
+// (e.g. set directly into the mutable context or inherited by the child helpers)
+func withTag(tags map[string]string, key, value string) map[string]string {
+	res := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		res[k] = v
+	}
+	res[key] = value
+	return res
+}
+
 type MetricHelper struct {
 	lock sync.Mutex
 
 	startingContext context.Context
 	meter           metric.Meter
 	metricPrefix    string
+	attrs           []attribute.KeyValue
+	tags            map[string]string
+	limiter         *CardinalityLimiter
+	preAggregate    bool
+	normalizeUnits  bool
+	emf             *EMFSink
+	instruments     *instrumentRegistry
 
 	metricsToZero   map[string]NamedMetric
 	metricsToSubmit map[string]NamedMetric
 	metricValues    map[string]float64
+	// The metrics recorded by Record, they can't be used as the counters
+	histograms map[string]bool
+	// The pre-aggregated values that are not yet submitted to the instruments
+	pending map[string]pendingValue
+	// The tags set by Tag, they are copied into the helpers created in this helper's context
+	scopeTags map[string]string
+	// The attributes added by the Observer, they are kept in the overflow series
+	observerAttrs []attribute.KeyValue
+}
+
+type pendingValue struct {
+	sum   float64
+	count int
 }
 
 type NamedMetric struct {
@@ -30,7 +83,9 @@ type NamedMetric struct {
 	Unit string
 }
 
+// Named creates the metric definition, it panics if the unit is unknown (see ValidateUnit)
 func Named(nm string, un string) NamedMetric {
+	utils.PanicIfF(ValidateUnit(un) != nil, "Unknown unit %q for metric %s", un, nm)
 	return NamedMetric{
 		Name: nm,
 		Unit: un,
@@ -67,16 +122,55 @@ func NewMetricContextWithPrefix(ctx context.Context, meter metric.Meter, metricP
 		metricsToZero:   make(map[string]NamedMetric),
 		metricsToSubmit: make(map[string]NamedMetric),
 		metricValues:    make(map[string]float64),
+		histograms:      make(map[string]bool),
+		pending:         make(map[string]pendingValue),
+	}
+	if parent := TryGetMetricHelperFromContext(ctx); parent != nil {
+		parent.lock.Lock()
+		res.scopeTags = parent.scopeTags
+		parent.lock.Unlock()
 	}
 	return res
 }
 
+// SetUnitNormalization makes the helper submit the values in the base units (e.g. "s" instead
+// of "ms", "By" instead of "KiBy"), which the Prometheus exporters expect. The values that
+// are accumulated in the helper and exported to the span keep the declared units.
+func (m *MetricHelper) SetUnitNormalization(enabled bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.normalizeUnits = enabled
+}
+
+// SetEMFSink makes the helper write its metrics to the EMF sink at Close, see EMFSink
+func (m *MetricHelper) SetEMFSink(sink *EMFSink) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.emf = sink
+}
+
+// SetPreAggregation makes the helper accumulate the values added by Add locally and submit
+// them to the instruments once, at Close. It's much cheaper for the metrics that are added
+// many times per request, but the values are only exported after Close, and the tags that
+// are set by then apply to all of them. Disabling it submits the pending values.
+func (m *MetricHelper) SetPreAggregation(enabled bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !enabled {
+		m.flushPending()
+	}
+	m.preAggregate = enabled
+}
+
 func (m *MetricHelper) Init(metrics ...NamedMetric) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	for _, cur := range metrics {
-		m.metricsToZero[cur.Name] = cur
+		m.initCounter(cur)
 	}
 }
 
@@ -85,10 +179,19 @@ func (m *MetricHelper) InitCounts(metrics ...string) {
 	defer m.lock.Unlock()
 
 	for _, cur := range metrics {
-		m.metricsToZero[cur] = NamedMetric{Name: cur, Unit: Dimensionless}
+		m.initCounter(NamedMetric{Name: cur, Unit: Dimensionless})
 	}
 }
 
+// initCounter declares the counter that is zero-filled by Close, the histograms can't
+// be zero-filled. Must be called with the lock held.
+func (m *MetricHelper) initCounter(nm NamedMetric) {
+	if m.histograms[nm.Name] {
+		panic("Metric " + nm.Name + " is used both as a histogram and as a counter")
+	}
+	m.metricsToZero[nm.Name] = nm
+}
+
 func (m *MetricHelper) AddCount(nm string, val float64) {
 	m.Add(NamedMetric{Name: nm, Unit: Dimensionless}, val)
 }
@@ -97,43 +200,237 @@ func (m *MetricHelper) Add(nm NamedMetric, val float64) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	// Make sure we don't submit the zero metric at the end of the call
-	delete(m.metricsToZero, nm.Name)
+	m.addLocked(nm, val)
+}
+
+// addLocked is Add that must be called with the lock held
+func (m *MetricHelper) addLocked(nm NamedMetric, val float64) {
+	nm, val, _ = m.register(nm, val, false)
+	m.metricValues[nm.Name] = m.metricValues[nm.Name] + val
+	m.submitOrAggregate(nm, val, 1)
+}
+
+// SetCount sets the value of the dimensionless metric, see Set
+func (m *MetricHelper) SetCount(nm string, val float64) {
+	m.Set(NamedMetric{Name: nm, Unit: Dimensionless}, val)
+}
+
+// Set overwrites the accumulated value of the metric. The difference from the previous value
+// is submitted to the counter, so the total submitted by this helper is the last value set
+// plus everything added after it. The sample count is not changed by overwriting, a Set of
+// a new metric counts as a single sample. Set can't be used for the histograms.
+func (m *MetricHelper) Set(nm NamedMetric, val float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	nm, val, known := m.register(nm, val, false)
+	count := 0
+	if !known {
+		count = 1
+	}
+	delta := val - m.metricValues[nm.Name]
+	m.metricValues[nm.Name] = val
+	m.submitOrAggregate(nm, delta, count)
+}
+
+// register declares the metric in the helper, the value is converted to the unit the
+// metric was declared with first (by Init or by the previous submissions). It panics if
+// the units are incompatible, or if a histogram is used as a counter or vice versa (the
+// metrics declared by Init are counters). The returned flag is true if the metric had
+// been submitted before. Must be called with the lock held.
+func (m *MetricHelper) register(nm NamedMetric, val float64, histogram bool) (NamedMetric, float64, bool) {
+	declared, submitted := m.metricsToSubmit[nm.Name]
+	zeroed, initialized := m.metricsToZero[nm.Name]
+	if (submitted || initialized) && m.histograms[nm.Name] != histogram {
+		panic("Metric " + nm.Name + " is used both as a histogram and as a counter")
+	}
+	if !submitted {
+		if initialized {
+			declared = zeroed
+		} else {
+			declared = nm
+		}
+		// Make sure we don't submit the zero metric at the end of the call
+		delete(m.metricsToZero, nm.Name)
+	}
+	if histogram {
+		m.histograms[nm.Name] = true
+	}
+	if declared.Unit != nm.Unit {
+		converted, err := ConvertUnit(val, nm.Unit, declared.Unit)
+		if err != nil {
+			panic("Inconsistent units for metric " + nm.Name + ": " + err.Error())
+		}
+		val = converted
+	}
 
 	// Register the metrics in our segment
-	curMet, ok := m.metricsToSubmit[nm.Name]
-	if ok && curMet.Unit != nm.Unit {
-		panic("Inconsistent units for metric " + nm.Name)
+	m.metricsToSubmit[nm.Name] = declared
+	return declared, val, submitted
+}
+
+// submitOrAggregate submits the value, or keeps it until Close if the pre-aggregation is
+// enabled. Must be called with the lock held.
+func (m *MetricHelper) submitOrAggregate(nm NamedMetric, val float64, count int) {
+	if m.preAggregate {
+		p := m.pending[nm.Name]
+		p.sum += val
+		p.count += count
+		m.pending[nm.Name] = p
+		return
 	}
-	m.metricsToSubmit[nm.Name] = nm
-	m.metricValues[nm.Name] = m.metricValues[nm.Name] + val
+	m.submit(nm, val, count)
+}
 
-	// Record the counter
-	hg, err := m.meter.Float64UpDownCounter(
-		m.metricPrefix+nm.Name, metric.WithUnit(nm.Unit))
-	utils.PanicIfErr(err)
-	hg.Add(context.Background(), val, m.getTags()...)
+// submit records the value and the number of samples it consists of.
+// Must be called with the lock held.
+func (m *MetricHelper) submit(nm NamedMetric, val float64, count int) {
+	// Record the counter, the sample count below goes into the same series
+	attrs := m.measurementAttrs(m.metricPrefix + nm.Name)
+	unit, exported := m.exportedValue(nm, val)
+	m.instruments.upDownCounter(m.meter, m.metricPrefix+nm.Name, unit).
+		Add(context.Background(), exported, attrs)
 
 	// Counters lose details since they are not submitted immediately, so make sure we submit
 	// the number of samples taken to be able to calculate the average value.
-	hgCnt, err := m.meter.Float64Counter(
-		m.metricPrefix+nm.Name+"_num", metric.WithUnit(Dimensionless))
-	utils.PanicIfErr(err)
-	hgCnt.Add(context.Background(), 1, m.getTags()...)
+	m.instruments.counter(m.meter, m.metricPrefix+nm.Name+"_num", Dimensionless).
+		Add(context.Background(), float64(count), attrs)
 }
 
-// Close submits all the remaining zero-valued metrics
-func (m *MetricHelper) Close() {
+// exportedValue returns the unit and the value to submit to the instruments, they are
+// converted to the base unit if the normalization is enabled
+func (m *MetricHelper) exportedValue(nm NamedMetric, val float64) (string, float64) {
+	if !m.normalizeUnits {
+		return nm.Unit, val
+	}
+	q := Quantity{Value: val, Unit: nm.Unit}.Normalized()
+	return q.Unit, q.Value
+}
+
+// flushPending submits the pre-aggregated values. Must be called with the lock held.
+func (m *MetricHelper) flushPending() {
+	for name, p := range m.pending {
+		m.submit(m.metricsToSubmit[name], p.sum, p.count)
+		delete(m.pending, name)
+	}
+}
+
+// Record records the value in a histogram, so that its distribution (e.g. the percentiles)
+// is preserved. The values are also accumulated in the helper, just like with Add, so
+// ExportToSpan reports their sum. The histograms are not zero-filled by Close, the
+// buckets for them can be configured with HistogramBuckets.
+func (m *MetricHelper) Record(nm NamedMetric, val float64) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	attrs := m.getTags()
+	nm, val, _ = m.register(nm, val, true)
+	m.metricValues[nm.Name] = m.metricValues[nm.Name] + val
 
+	// The histograms are not pre-aggregated, that would lose the distribution
+	unit, exported := m.exportedValue(nm, val)
+	m.instruments.histogram(m.meter, m.metricPrefix+nm.Name, unit).
+		Record(context.Background(), exported, m.measurementAttrs(m.metricPrefix+nm.Name))
+}
+
+// RecordDuration records the duration in milliseconds in a histogram, see Record
+func (m *MetricHelper) RecordDuration(name string, duration time.Duration) {
+	m.Record(Named(name, UnitMilliseconds), float64(duration)/float64(time.Millisecond))
+}
+
+// AddDuration adds the duration to the metric, converted to the unit the metric was declared
+// with (by Init or by the previous additions), or to milliseconds for the new metrics.
+// It panics if the metric is declared with a non-time unit.
+func (m *MetricHelper) AddDuration(name string, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// The unit can't change between the lookup and the addition, e.g. by a concurrent Init
+	unit := UnitMilliseconds
+	if nm, ok := m.metricsToSubmit[name]; ok {
+		unit = nm.Unit
+	} else if nm, ok = m.metricsToZero[name]; ok {
+		unit = nm.Unit
+	}
+
+	val, err := ConvertUnit(float64(duration), UnitNanoseconds, unit)
+	utils.PanicIfF(err != nil, "The metric %s has a non-time unit %s", name, unit)
+	m.addLocked(Named(name, unit), val)
+}
+
+// MetricTimer measures the time until Stop, see MetricHelper.StartTimer
+type MetricTimer struct {
+	helper  *MetricHelper
+	name    string
+	start   time.Time
+	stopped atomic.Bool
+}
+
+// StartTimer starts measuring the time for the metric, it's added with AddDuration when
+// the timer is stopped. Use it like: defer mh.StartTimer("DbLatency").Stop()
+func (m *MetricHelper) StartTimer(name string) *MetricTimer {
+	return &MetricTimer{helper: m, name: name, start: time.Now()}
+}
+
+// Stop adds the elapsed time to the metric and returns it. Only the first call has an effect,
+// the subsequent calls return zero.
+func (t *MetricTimer) Stop() time.Duration {
+	if t.stopped.Swap(true) {
+		return 0
+	}
+	elapsed := time.Since(t.start)
+	t.helper.AddDuration(t.name, elapsed)
+	return elapsed
+}
+
+// Close submits the pre-aggregated values and all the remaining zero-valued metrics. If the
+// EMF sink is set, all the accumulated values are written to it as well, so Close must be
+// called only once (or Reset must be called in between).
+func (m *MetricHelper) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.flushPending()
 	for _, val := range m.metricsToZero {
-		counter, err := m.meter.Float64UpDownCounter(
-			m.metricPrefix+val.Name, metric.WithUnit(val.Unit))
-		utils.PanicIfErr(err)
-		counter.Add(context.Background(), 0, attrs...)
+		unit, _ := m.exportedValue(val, 0)
+		m.instruments.upDownCounter(m.meter, m.metricPrefix+val.Name, unit).
+			Add(context.Background(), 0, m.measurementAttrs(m.metricPrefix+val.Name))
+	}
+
+	if m.emf != nil {
+		m.writeEMF()
+	}
+}
+
+// writeEMF writes the accumulated values to the EMF sink. The dimensions are subject to the
+// cardinality limits, so the metrics whose series overflowed are written as a separate line
+// with the overflow dimension. Must be called with the lock held.
+func (m *MetricHelper) writeEMF() {
+	type emfLine struct {
+		attrs   []attribute.KeyValue
+		metrics map[string]NamedMetric
+		values  map[string]float64
+	}
+	var lines []*emfLine
+	byAttrs := make(map[attribute.Distinct]*emfLine)
+
+	set := attribute.NewSet(m.attributes()...)
+	for _, all := range []map[string]NamedMetric{m.metricsToZero, m.metricsToSubmit} {
+		for name, nm := range all {
+			limited := m.limiter.Limit(m.metricPrefix+name, set, m.observerAttrs...)
+			line := byAttrs[limited.Equivalent()]
+			if line == nil {
+				line = &emfLine{attrs: limited.ToSlice(), metrics: make(map[string]NamedMetric),
+					values: make(map[string]float64)}
+				byAttrs[limited.Equivalent()] = line
+				lines = append(lines, line)
+			}
+			line.metrics[m.metricPrefix+name] = nm
+			line.values[m.metricPrefix+name] = m.metricValues[name]
+		}
+	}
+
+	for _, line := range lines {
+		m.emf.Write(line.metrics, line.values, line.attrs)
 	}
 }
 
@@ -147,10 +444,85 @@ func (m *MetricHelper) ExportToSpan(span trace.Span) {
 	}
 }
 
-func (m *MetricHelper) getTags() []metric.AddOption {
-	var attrs []metric.AddOption
-	//for k, v := range m.tags {
-	//	attrs = append(attrs, attribute.String(k, v))
-	//}
-	return attrs
+// Get returns the accumulated value of the metric and its unit. The metrics declared with
+// Init are reported with the zero value. The ok is false if the metric is unknown.
+func (m *MetricHelper) Get(name string) (value float64, unit string, ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if nm, present := m.metricsToSubmit[name]; present {
+		return m.metricValues[name], nm.Unit, true
+	}
+	if nm, present := m.metricsToZero[name]; present {
+		return 0, nm.Unit, true
+	}
+	return 0, "", false
+}
+
+// Snapshot returns a copy of the accumulated metric values, the same ones that
+// ExportToSpan reports (without the prefix)
+func (m *MetricHelper) Snapshot() map[string]float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	res := make(map[string]float64, len(m.metricValues))
+	for k, v := range m.metricValues {
+		res[k] = v
+	}
+	return res
+}
+
+// Reset forgets the accumulated values, the metrics declared with Init and the pre-aggregated
+// values that are not submitted yet, so that the helper can be reused. The values that were
+// already submitted are not affected, call Close before Reset to submit the rest of them.
+// The tags are kept.
+func (m *MetricHelper) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.metricsToZero = make(map[string]NamedMetric)
+	m.metricsToSubmit = make(map[string]NamedMetric)
+	m.metricValues = make(map[string]float64)
+	m.histograms = make(map[string]bool)
+	m.pending = make(map[string]pendingValue)
+}
+
+// SetTag adds the metric dimension to all the metrics submitted by this helper, it
+// overrides the tags from the context
+func (m *MetricHelper) SetTag(key, value string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.tags == nil {
+		m.tags = make(map[string]string)
+	}
+	m.tags[key] = value
+}
+
+// attributes merges the fixed attributes, the tags from the mutable context, the scoped
+// tags and the helper's own tags. Must be called with the lock held.
+func (m *MetricHelper) attributes() []attribute.KeyValue {
+	var ctxTags []map[string]string
+	if m.startingContext != nil {
+		ctxTags = utils.GetAllMutableContextValues(m.startingContext, MetricTagKey)
+	}
+	if len(ctxTags) == 0 && len(m.scopeTags) == 0 && len(m.tags) == 0 {
+		return m.attrs
+	}
+
+	// The later values override the earlier ones in the attribute set
+	res := appendAttrs(m.attrs, nil)
+	for _, tags := range append(ctxTags, m.scopeTags, m.tags) {
+		for k, v := range tags {
+			res = append(res, attribute.String(k, v))
+		}
+	}
+	return res
+}
+
+// measurementAttrs returns the attributes for the instrument, subject to the cardinality
+// limits. Must be called with the lock held.
+func (m *MetricHelper) measurementAttrs(instrument string) metric.MeasurementOption {
+	set := attribute.NewSet(m.attributes()...)
+	return metric.WithAttributeSet(m.limiter.Limit(instrument, set, m.observerAttrs...))
 }
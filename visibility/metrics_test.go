@@ -1,5 +1,333 @@
 package visibility
 
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/utils"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricTags(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	obs.MetricAttributes = []attribute.KeyValue{attribute.String("service", "storage")}
+
+	ctx := utils.ForkMutableContext(context.Background())
+	utils.SetMutableContextValue(ctx, MetricTagKey, map[string]string{"tenant": "acme", "tier": "free"})
+
+	sp, spanCtx := BeginNewSpan(ctx, obs, "Upload", WithMetrics())
+	// Overrides the inherited value, only for this span
+	Tag(spanCtx, "tier", "paid")
+	mh := GetMetricHelperFromContext(spanCtx)
+	mh.SetTag("region", "eu")
+	mh.AddCount("Files", 2)
+	CleanupSpan(sp)
+
+	sp, _ = BeginNewSpan(ctx, obs, "Download", WithMetrics())
+	CleanupSpan(sp)
+
+	uploadAttrs := attribute.NewSet(attribute.String("service", "storage"), attribute.String("tenant", "acme"),
+		attribute.String("tier", "paid"), attribute.String("region", "eu"))
+	downloadAttrs := attribute.NewSet(attribute.String("service", "storage"), attribute.String("tenant", "acme"),
+		attribute.String("tier", "free"))
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	seen := map[string]bool{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		for _, p := range m.Data.(metricdata.Sum[float64]).DataPoints {
+			seen[m.Name] = true
+			if strings.HasPrefix(m.Name, "Download") {
+				assert.Equal(t, downloadAttrs, p.Attributes, m.Name)
+			} else {
+				assert.Equal(t, uploadAttrs, p.Attributes, m.Name)
+			}
+		}
+	}
+	assert.True(t, seen["UploadSuccess"])
+	assert.True(t, seen["DownloadSuccess"])
+
+	// The tags in the outer context are not affected
+	tags, _ := utils.TryGetMutableContextValue(ctx, MetricTagKey)
+	assert.Equal(t, "free", tags["tier"])
+}
+
+func TestMetricTagsInChildSpans(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	// The non-metric values set inside the span still reach the caller
+	requestKey := utils.NewMutableContextKey[string]("request")
+	ctx := utils.ForkMutableContext(context.Background())
+
+	sp, spanCtx := BeginNewSpan(ctx, obs, "Parent", WithMetrics())
+	Tag(spanCtx, "tenant", "acme")
+	utils.SetMutableContextValue(spanCtx, requestKey, "r-1")
+
+	child, childCtx := BeginNewSpan(spanCtx, obs, "Child", WithMetrics())
+	Tag(childCtx, "tier", "paid")
+	CleanupSpan(child)
+	CleanupSpan(sp)
+
+	request, _ := utils.TryGetMutableContextValue(ctx, requestKey)
+	assert.Equal(t, "r-1", request)
+	_, ok := utils.TryGetMutableContextValue(ctx, MetricTagKey)
+	assert.False(t, ok)
+
+	parentAttrs := attribute.NewSet(attribute.String("tenant", "acme"))
+	childAttrs := attribute.NewSet(attribute.String("tenant", "acme"), attribute.String("tier", "paid"))
+	assert.Equal(t, map[attribute.Distinct]float64{parentAttrs.Equivalent(): 1},
+		collectSumSets(t, reader, "ParentSuccess"))
+	assert.Equal(t, map[attribute.Distinct]float64{childAttrs.Equivalent(): 1},
+		collectSumSets(t, reader, "ChildSuccess"))
+}
+
+func TestMetricPreAggregation(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	obs.PreAggregateMetrics = true
+
+	mh := obs.MakeMetricHelper(context.Background())
+	mh.InitCounts("Errors")
+	for i := 0; i < 10; i++ {
+		mh.Add(Named("Bytes", UnitBytes), 100)
+	}
+	mh.RecordDuration("Latency", 5*time.Millisecond)
+	mh.SetTag("tier", "paid")
+
+	sums := func() map[string]metricdata.DataPoint[float64] {
+		rm := metricdata.ResourceMetrics{}
+		assert.NoError(t, reader.Collect(context.Background(), &rm))
+		res := map[string]metricdata.DataPoint[float64]{}
+		for _, m := range rm.ScopeMetrics[0].Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[float64]); ok {
+				res[m.Name] = sum.DataPoints[0]
+			}
+		}
+		return res
+	}
+	// Nothing is submitted before Close, except for the histograms
+	assert.Empty(t, sums())
+	assert.Equal(t, 1000.0, mh.Snapshot()["Bytes"])
+
+	mh.Close()
+	res := sums()
+	tagged := attribute.NewSet(attribute.String("tier", "paid"))
+	assert.Equal(t, 1000.0, res["Bytes"].Value)
+	assert.Equal(t, tagged, res["Bytes"].Attributes)
+	assert.Equal(t, 10.0, res["Bytes_num"].Value)
+	assert.Equal(t, 0.0, res["Errors"].Value)
+
+	// The values are not submitted twice, and disabling the pre-aggregation flushes them
+	mh.Add(Named("Bytes", UnitBytes), 1)
+	mh.Close()
+	mh.Add(Named("Bytes", UnitBytes), 1)
+	mh.SetPreAggregation(false)
+	mh.Add(Named("Bytes", UnitBytes), 1)
+	res = sums()
+	assert.Equal(t, 1003.0, res["Bytes"].Value)
+	assert.Equal(t, 13.0, res["Bytes_num"].Value)
+}
+
+func TestMetricDurations(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	sp, ctx := BeginNewSpan(context.Background(), obs, "Query", WithMetrics())
+	mh := GetMetricHelperFromContext(ctx)
+	mh.Init(Named("DbLatency", UnitMicroseconds), Named("Size", UnitBytes))
+	mh.AddDuration("DbLatency", 2*time.Millisecond)
+	// The new metrics are in milliseconds
+	mh.AddDuration("WaitTime", 1500*time.Microsecond)
+
+	timer := mh.StartTimer("DbLatency")
+	time.Sleep(5 * time.Millisecond)
+	elapsed := timer.Stop()
+	assert.True(t, elapsed >= 5*time.Millisecond)
+	assert.Equal(t, time.Duration(0), timer.Stop())
+
+	assert.Panics(t, func() { mh.AddDuration("Size", time.Second) })
+	CleanupSpan(sp)
+
+	values := rec.Get()
+	dbLatency := 2000 + float64(elapsed)/float64(time.Microsecond)
+	assert.Equal(t, dbLatency, values.Metrics["DbLatency"])
+	assert.Equal(t, 1.5, values.Metrics["WaitTime"])
+
+	exported := map[string]float64{}
+	for _, attr := range values.Spans[0].Attributes() {
+		exported[string(attr.Key)] = attr.Value.AsFloat64()
+	}
+	assert.Equal(t, dbLatency, exported["DbLatency"])
+	assert.Equal(t, 1.5, exported["WaitTime"])
+}
+
+func TestMetricSetGetReset(t *testing.T) {
+	for _, preAggregate := range []bool{false, true} {
+		obs, _ := NewRecordingObserver(zap.NewNop())
+		reader := sdkmetric.NewManualReader()
+		obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+		obs.PreAggregateMetrics = preAggregate
+
+		mh := obs.MakeMetricHelper(context.Background())
+		mh.Init(Named("Speed", UnitBytesSec))
+		val, unit, ok := mh.Get("Speed")
+		assert.Equal(t, 0.0, val)
+		assert.Equal(t, UnitBytesSec, unit)
+		assert.True(t, ok)
+
+		mh.SetCount("Items", 11)
+		mh.SetCount("Items", 12) // Overrides
+		mh.AddCount("Items", 2)
+		mh.Add(Named("Speed", UnitBytesSec), 5)
+		mh.Set(Named("Speed", UnitBytesSec), 123)
+		assert.Panics(t, func() { mh.Set(Named("Speed", UnitBytes), 1) })
+
+		val, unit, ok = mh.Get("Items")
+		assert.Equal(t, 14.0, val)
+		assert.Equal(t, Dimensionless, unit)
+		assert.True(t, ok)
+		_, _, ok = mh.Get("Missing")
+		assert.False(t, ok)
+		assert.Equal(t, map[string]float64{"Items": 14, "Speed": 123}, mh.Snapshot())
+
+		mh.Close()
+		sums := collectMetricSums(t, reader)
+		assert.Equal(t, 14.0, sums["Items"])
+		assert.Equal(t, 2.0, sums["Items_num"])
+		assert.Equal(t, 123.0, sums["Speed"])
+		assert.Equal(t, 1.0, sums["Speed_num"])
+
+		// Nothing is submitted after Reset, and the helper can be reused
+		mh.AddCount("Items", 1000)
+		mh.Reset()
+		mh.Reset() // Idempotent
+		_, _, ok = mh.Get("Items")
+		assert.False(t, ok)
+		assert.Empty(t, mh.Snapshot())
+		mh.AddCount("Items", 1)
+		mh.Close()
+
+		sums = collectMetricSums(t, reader)
+		if preAggregate {
+			assert.Equal(t, 15.0, sums["Items"])
+		} else {
+			// The values submitted before the Reset stay
+			assert.Equal(t, 1015.0, sums["Items"])
+		}
+		obs.Shutdown(context.Background())
+	}
+}
+
+func TestMetricUnits(t *testing.T) {
+	assert.Panics(t, func() { Named("Size", "bytes") })
+
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	// The compatible units are converted to the declared one
+	mh := obs.MakeMetricHelper(context.Background())
+	mh.Init(Named("Wait", UnitMilliseconds))
+	mh.Add(Named("Wait", UnitSeconds), 1.5)
+	mh.Add(Named("Size", UnitKibiBytes), 1)
+	mh.Add(Named("Size", UnitBytes), 512)
+	assert.Panics(t, func() { mh.Add(Named("Size", UnitSeconds), 1) })
+	val, unit, _ := mh.Get("Wait")
+	assert.Equal(t, 1500.0, val)
+	assert.Equal(t, UnitMilliseconds, unit)
+	assert.Equal(t, map[string]float64{"Wait": 1500, "Size": 1.5}, mh.Snapshot())
+
+	// The normalized values are submitted in the base units
+	normalized := obs.MakeMetricHelper(context.Background())
+	normalized.SetUnitNormalization(true)
+	normalized.Add(Named("Latency", UnitMilliseconds), 250)
+	normalized.Add(Named("Payload", UnitKibiBytes), 2)
+	assert.Equal(t, map[string]float64{"Latency": 250, "Payload": 2}, normalized.Snapshot())
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	exported := map[string]Quantity{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		exported[m.Name] = Quantity{Value: m.Data.(metricdata.Sum[float64]).DataPoints[0].Value, Unit: m.Unit}
+	}
+	assert.Equal(t, Quantity{Value: 1500, Unit: UnitMilliseconds}, exported["Wait"])
+	assert.Equal(t, Quantity{Value: 1.5, Unit: UnitKibiBytes}, exported["Size"])
+	assert.Equal(t, Quantity{Value: 0.25, Unit: UnitSeconds}, exported["Latency"])
+	assert.Equal(t, Quantity{Value: 2048, Unit: UnitBytesUCUM}, exported["Payload"])
+}
+
+func TestCanaryMetrics(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	canaryCtx := MarkAsCanary(context.Background(), true)
+	sp, _ := BeginNewSpan(canaryCtx, obs, "Probe", WithMetrics())
+	CleanupSpan(sp)
+	sp, _ = BeginNewSpan(context.Background(), obs, "Probe", WithMetrics())
+	CleanupSpan(sp)
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	byCanary := map[bool]float64{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		if m.Name != "ProbeSuccess" {
+			continue
+		}
+		for _, p := range m.Data.(metricdata.Sum[float64]).DataPoints {
+			byCanary[CanaryMetricsOnly(rm.ScopeMetrics[0].Scope, m.Name, p.Attributes)] += p.Value
+			assert.NotEqual(t, CanaryMetricsOnly(rm.ScopeMetrics[0].Scope, m.Name, p.Attributes),
+				NonCanaryMetricsOnly(rm.ScopeMetrics[0].Scope, m.Name, p.Attributes))
+		}
+	}
+	assert.Equal(t, map[bool]float64{true: 1, false: 1}, byCanary)
+
+	// The canary metrics can be segregated by the prefix instead
+	obs, rec = NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+	obs.CanaryMetricPrefix = "Canary."
+	sp, _ = BeginNewSpan(canaryCtx, obs, "Probe", WithMetrics())
+	CleanupSpan(sp)
+	sp, _ = BeginNewSpan(context.Background(), obs, "Probe", WithMetrics())
+	CleanupSpan(sp)
+
+	values := rec.Get()
+	assert.Equal(t, 1.0, values.Metrics["Canary.ProbeSuccess"])
+	assert.Equal(t, 1.0, values.Metrics["ProbeSuccess"])
+}
+
+func collectMetricSums(t *testing.T, reader sdkmetric.Reader) map[string]float64 {
+	rm := metricdata.ResourceMetrics{}
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	res := map[string]float64{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		if sum, ok := m.Data.(metricdata.Sum[float64]); ok {
+			for _, p := range sum.DataPoints {
+				res[m.Name] += p.Value
+			}
+		}
+	}
+	return res
+}
+
 //func TestMetricsContext(t *testing.T) {
 //	ctx := MakeMetricHelper(context.Background(), "TestOp")
 //	mctx := GetMetricHelperFromContext(ctx)
@@ -7,6 +7,8 @@ import (
     v1 "go.opentelemetry.io/proto/otlp/metrics/v1"
     tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
     "google.golang.org/grpc"
+    "google.golang.org/grpc/health"
+    healthpb "google.golang.org/grpc/health/grpc_health_v1"
     "net"
     "sync"
     "testing"
@@ -71,6 +73,8 @@ type mockCollector struct {
     server    *grpc.Server
     traceSvc  *mockTraceService
     metricSvc *mockMetricService
+    // The health service is used to test the streaming calls
+    healthSvc *health.Server
 
     endpoint string
 }
@@ -87,20 +91,28 @@ func (mc *mockCollector) Get() ([]*tracepb.ResourceSpans, []*v1.ResourceMetrics)
 }
 
 func runMockCollector(t *testing.T) *mockCollector {
+    return runMockCollectorWithOptions(t)
+}
+
+// runMockCollectorWithOptions allows to run the collector with the gRPC interceptors,
+// to test the instrumentation against a real gRPC server
+func runMockCollectorWithOptions(t *testing.T, opts ...grpc.ServerOption) *mockCollector {
     ln, err := net.Listen("tcp", "localhost:0")
     if err != nil {
         t.Fatalf("Failed to get an endpoint: %v", err)
     }
 
-    srv := grpc.NewServer()
+    srv := grpc.NewServer(opts...)
     mc := &mockCollector{
         t:         t,
         traceSvc:  &mockTraceService{},
         metricSvc: &mockMetricService{},
+        healthSvc: health.NewServer(),
     }
 
     collectortracepb.RegisterTraceServiceServer(srv, mc.traceSvc)
     metricspb.RegisterMetricsServiceServer(srv, mc.metricSvc)
+    healthpb.RegisterHealthServer(srv, mc.healthSvc)
 
     go func() {
         _ = srv.Serve(ln)
@@ -3,21 +3,22 @@ package visibility
 import (
 	"context"
 	"github.com/Cyberax/argus-vision/visibility/logging"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/atomic"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"os"
 	"strconv"
 	"time"
-
-	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 )
 
 type Observer struct {
@@ -33,13 +34,57 @@ type Observer struct {
 
 	LogFieldsForSpan func(span trace.Span) []zap.Field
 
-	Shutdown func(ctx context.Context)
+	// The attributes added to all the spans started by BeginNewSpan
+	DefaultSpanAttributes []attribute.KeyValue
+	// The attributes added to all the metrics submitted through the MetricHelper
+	MetricAttributes []attribute.KeyValue
+
+	// What to do with the spans that were never passed to CleanupSpan
+	LeakPolicy SpanLeakPolicy
+
+	// Propagates the trace context and baggage across the process boundaries in the
+	// HTTP and gRPC instrumentation, DefaultPropagator is used if it's nil
+	Propagator propagation.TextMapPropagator
+
+	// The runtime controls, see AdminHandler. They are nil if the corresponding
+	// functionality is not available.
+	LogLevels *logging.LevelControl
+	Sampler   *SwitchableSampler
+	// The spans that take longer than this are logged with a warning, 0 turns it off
+	SlowSpanThreshold *atomic.Duration
+
+	// Limits the cardinality of the metrics submitted through the MetricHelper, it's
+	// shared with the scoped children. It's nil (nothing is tracked) if no limits are set.
+	Cardinality *CardinalityLimiter
+	// The MetricHelpers pre-aggregate the values until Close, see MetricHelper.SetPreAggregation
+	PreAggregateMetrics bool
+	// The MetricHelpers submit the values in the base units, see MetricHelper.SetUnitNormalization
+	NormalizeUnits bool
+	// The metrics of the canary requests are submitted with this prefix instead of the
+	// canary attribute, so that they can't be mixed with the real traffic by accident
+	CanaryMetricPrefix string
+	// The MetricHelpers also write their metrics in the CloudWatch Embedded Metric Format
+	// when they are closed, if it's set
+	EMF *EMFSink
+
+	// The instruments of the MetricHelpers, it's shared with the scoped children
+	instruments *instrumentRegistry
+	// The readers of the MeterController, for the external metric producers
+	metricReaders []sdkmetric.Reader
+
+	// Flushes and shuts down the trace and meter providers
+	Shutdown func(ctx context.Context) error
 }
 
 type ObserverOptions struct {
 	MetricsEndpoint string // localhost:4317 is the default
 	TracingEndpoint string // localhost:4317 is the default
 
+	// Additional backends to send the telemetry to, they are used in addition
+	// to the MetricsEndpoint and TracingEndpoint (if they are not empty)
+	MetricExporters []MetricExporterOptions
+	TraceExporters  []TraceExporterOptions
+
 	// The name of the application or library that is being traced.
 	// E.g. if you are instrumenting YourCoolApp then set this to "YourCoolApp"
 	LibraryName string
@@ -47,10 +92,50 @@ type ObserverOptions struct {
 
 	// The ID generator for the spans, can be customized to produce predictable IDs
 	IdGenerator sdktrace.IDGenerator
+
+	// The trace sampler, all the traces are sampled if it's nil
+	Sampler sdktrace.Sampler
+
+	// What to do with the spans that were never passed to CleanupSpan
+	LeakPolicy SpanLeakPolicy
+
+	// The spans that take longer than this are logged with a warning, 0 turns it off
+	SlowSpanThreshold time.Duration
+
+	// The bucket boundaries for the histograms recorded by MetricHelper.Record
+	HistogramBuckets HistogramBuckets
+
+	// The limits for the number of the distinct attribute sets of the metrics
+	CardinalityLimits CardinalityLimits
+
+	// Pre-aggregate the metric values in the MetricHelpers, see MetricHelper.SetPreAggregation
+	PreAggregateMetrics bool
+
+	// Submit the metric values in the base units (e.g. "s" and "By"), for Prometheus. Note that
+	// the histogram buckets have to be specified in the base units too.
+	NormalizeUnits bool
+
+	// The prefix for the metrics of the canary requests, they get the canary attribute if it's empty
+	CanaryMetricPrefix string
+
+	// Write the metrics in the CloudWatch Embedded Metric Format with this namespace through
+	// the root logger (it must use the JSON encoding), see EMFSink. Leave the metric endpoints
+	// empty to use EMF instead of the OTel exporters.
+	EMFNamespace string
+
+	// Publish the Go runtime metrics, see Observer.StartRuntimeMetrics
+	RuntimeMetrics bool
+
+	// The global otel.ErrorHandler is replaced by default, so that the OTel errors (e.g. failed
+	// exports) are logged through the Observer's Logger with rate limiting, and counted in the
+	// otel.errors metric. Set this to leave the global handler alone.
+	KeepErrorHandler bool
 }
 
 func NewDefaultObserverOptions(libraryName, serviceName, envName string) (ObserverOptions, error) {
 	envInfo, err := resource.New(context.Background(),
+		// Container ID, Kubernetes downward API variables and the build information
+		resource.WithDetectors(NewContainerDetector(), NewKubernetesDetector(), NewBuildInfoDetector()),
 		// pull attributes from OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME environment variables
 		resource.WithFromEnv(),
 		// This option configures a set of Detectors that discovers the process information
@@ -95,78 +180,149 @@ func NewBlindObserverOptions() ObserverOptions {
 }
 
 func NewObserver(rootLogger *zap.Logger, opts ObserverOptions) (*Observer, error) {
+	levels := logging.NewLevelControl(rootLogger)
 	res := &Observer{
-		Logger:             rootLogger,
+		Logger:             levels.WrapLogger(rootLogger),
 		DefaultLibraryName: opts.LibraryName,
 		Resource:           opts.Resource,
 
 		LogFieldsForSpan: DatadogLogDerivation,
+		LeakPolicy:       opts.LeakPolicy,
+
+		LogLevels:           levels,
+		SlowSpanThreshold:   atomic.NewDuration(opts.SlowSpanThreshold),
+		PreAggregateMetrics: opts.PreAggregateMetrics,
+		NormalizeUnits:      opts.NormalizeUnits,
+		CanaryMetricPrefix:  opts.CanaryMetricPrefix,
+		instruments:         &instrumentRegistry{},
+	}
+	if err := opts.CardinalityLimits.Validate(); err != nil {
+		return nil, err
+	}
+	if !opts.CardinalityLimits.IsUnlimited() {
+		res.Cardinality = NewCardinalityLimiter(res.Logger, opts.CardinalityLimits)
+	}
+	if opts.EMFNamespace != "" {
+		res.EMF = NewEMFSink(res.Logger.Named("emf"), opts.EMFNamespace)
 	}
 
 	var tp *sdktrace.TracerProvider
-	var pusher metric.MeterProvider
+	var mp *sdkmetric.MeterProvider
+	tel := &selfTelemetry{}
+
+	// Shuts down everything that was built so far, if one of the later steps fails
+	var cleanups []func()
+	fail := func(err error) (*Observer, error) {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+		return nil, err
+	}
 
 	// Metrics
+	metricExporters := opts.MetricExporters
 	if opts.MetricsEndpoint != "" {
-		options := []otlpmetricgrpc.Option{
-			otlpmetricgrpc.WithInsecure(),
-			otlpmetricgrpc.WithEndpoint(opts.MetricsEndpoint),
-		}
+		metricExporters = append([]MetricExporterOptions{{Endpoint: opts.MetricsEndpoint}},
+			metricExporters...)
+	}
 
-		client, err := otlpmetricgrpc.New(context.Background(), options...)
+	if len(metricExporters) != 0 {
+		views, err := opts.HistogramBuckets.Views(opts.CanaryMetricPrefix)
 		if err != nil {
 			return nil, err
 		}
-
-		pusher = sdkmetric.NewMeterProvider(
-			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(client,
-				sdkmetric.WithInterval(2*time.Second),
-				sdkmetric.WithTimeout(2*time.Second),
-			)),
-			sdkmetric.WithResource(opts.Resource),
-		)
-
-		res.MeterController = pusher
-
-		if err != nil {
-			return nil, err
+		meterOpts := []sdkmetric.Option{sdkmetric.WithResource(opts.Resource), sdkmetric.WithView(views...)}
+		for _, me := range metricExporters {
+			reader, err := newMetricReader(me, tel)
+			if err != nil {
+				return fail(err)
+			}
+			cleanups = append(cleanups, func() { _ = reader.Shutdown(context.Background()) })
+			meterOpts = append(meterOpts, sdkmetric.WithReader(reader))
+			res.metricReaders = append(res.metricReaders, reader)
 		}
+
+		mp = sdkmetric.NewMeterProvider(meterOpts...)
+		// The provider owns the readers now
+		cleanups = []func(){func() { _ = mp.Shutdown(context.Background()) }}
+		res.MeterController = mp
 	} else {
 		res.MeterController = noop.NewMeterProvider()
 	}
 
+	err := tel.init(res.MeterController)
+	if err != nil {
+		return fail(err)
+	}
+
 	// Traces
+	traceExporters := opts.TraceExporters
 	if opts.TracingEndpoint != "" {
-		tracerOpts := []otlptracegrpc.Option{
-			otlptracegrpc.WithInsecure(),
-			otlptracegrpc.WithEndpoint(opts.TracingEndpoint),
+		traceExporters = append([]TraceExporterOptions{{Endpoint: opts.TracingEndpoint}},
+			traceExporters...)
+	}
+
+	if len(traceExporters) != 0 {
+		sampler := opts.Sampler
+		if sampler == nil {
+			sampler = sdktrace.AlwaysSample()
 		}
-		traceClient := otlptracegrpc.NewClient(tracerOpts...)
-		traceExporter, err := otlptrace.New(context.Background(), traceClient)
-		if err != nil {
-			return nil, err
+		switchable, ok := sampler.(*SwitchableSampler)
+		if !ok {
+			switchable = NewSwitchableSampler(sampler)
 		}
+		res.Sampler = switchable
 
-		tp = sdktrace.NewTracerProvider(
+		tracerOpts := []sdktrace.TracerProviderOption{
 			sdktrace.WithResource(opts.Resource),
-			sdktrace.WithSampler(sdktrace.AlwaysSample()),
+			sdktrace.WithSampler(switchable),
 			sdktrace.WithIDGenerator(opts.IdGenerator),
-			sdktrace.WithBatcher(
-				traceExporter,
-				sdktrace.WithBatchTimeout(5*time.Second),
-				sdktrace.WithMaxExportBatchSize(10),
-			),
-		)
+		}
+		metricCleanups := len(cleanups)
+		for _, te := range traceExporters {
+			processor, err := newSpanProcessor(te, tel)
+			if err != nil {
+				return fail(err)
+			}
+			cleanups = append(cleanups, func() { _ = processor.Shutdown(context.Background()) })
+			tracerOpts = append(tracerOpts, sdktrace.WithSpanProcessor(processor))
+		}
 
+		tp = sdktrace.NewTracerProvider(tracerOpts...)
+		// The provider owns the processors now
+		cleanups = append(cleanups[:metricCleanups], func() { _ = tp.Shutdown(context.Background()) })
 		res.TraceProvider = tp
 	} else {
 		res.TraceProvider = trace.NewNoopTracerProvider()
 	}
 
-	res.Shutdown = func(ctx context.Context) {
+	var runtimeReg metric.Registration
+	if opts.RuntimeMetrics {
+		runtimeReg, err = res.StartRuntimeMetrics()
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	// The global handler is replaced only once nothing can fail anymore
+	if !opts.KeepErrorHandler {
+		otel.SetErrorHandler(newErrorHandler(res.Logger, tel))
+	}
+
+	res.Shutdown = func(ctx context.Context) error {
+		res.instruments.clear()
+		if runtimeReg != nil {
+			_ = runtimeReg.Unregister()
+		}
+		var err error
 		if tp != nil {
-			_ = tp.Shutdown(ctx)
+			err = multierr.Append(err, tp.Shutdown(ctx))
+		}
+		// The metric readers are flushed by the shutdown
+		if mp != nil {
+			err = multierr.Append(err, mp.Shutdown(ctx))
 		}
+		return err
 	}
 
 	return res, nil
@@ -200,6 +356,29 @@ func convertDatadogTraceIDToLogId(id string) string {
 	return strconv.FormatUint(intValue, 10)
 }
 
+// Scoped creates a child observer for a logical component of the application. The child
+// shares the providers with its parent, but it has its own instrumentation scope, logger
+// name and the additional attributes for the spans and metrics. The parent's attributes
+// are inherited.
+//
+// The child does not own the providers, so its Shutdown does nothing.
+func (o *Observer) Scoped(libraryName string, attrs ...attribute.KeyValue) *Observer {
+	res := *o
+	res.DefaultLibraryName = libraryName
+	res.Logger = o.Logger.Named(libraryName)
+	res.DefaultSpanAttributes = appendAttrs(o.DefaultSpanAttributes, attrs)
+	res.MetricAttributes = appendAttrs(o.MetricAttributes, attrs)
+	res.Shutdown = func(ctx context.Context) error { return nil }
+	return &res
+}
+
+// appendAttrs never modifies the parent's slice, so the siblings don't step on each other
+func appendAttrs(parent []attribute.KeyValue, attrs []attribute.KeyValue) []attribute.KeyValue {
+	res := make([]attribute.KeyValue, 0, len(parent)+len(attrs))
+	res = append(res, parent...)
+	return append(res, attrs...)
+}
+
 func (o *Observer) ContextWithLogger(parent context.Context, name string, fields ...zap.Field) context.Context {
 	parentLogger := logging.TryGetLoggerFromContext(parent)
 	if parentLogger == nil {
@@ -214,11 +393,28 @@ func (o *Observer) ContextWithLogger(parent context.Context, name string, fields
 }
 
 func (o *Observer) MakeMetricHelper(ctx context.Context) *MetricHelper {
-	return NewMetricContext(ctx, o.MeterController.Meter(o.DefaultLibraryName))
+	return o.MakeMetricHelperWithPrefix(ctx, "")
 }
 
+// MakeMetricHelperWithPrefix creates the helper for the context. The metrics of the canary
+// requests (see IsCanaryRequest) get the canary attribute, or the CanaryMetricPrefix.
 func (o *Observer) MakeMetricHelperWithPrefix(ctx context.Context, prefix string) *MetricHelper {
-	return NewMetricContextWithPrefix(ctx, o.MeterController.Meter(o.DefaultLibraryName), prefix)
+	canary := IsCanaryRequest(ctx)
+	if canary && o.CanaryMetricPrefix != "" {
+		prefix = o.CanaryMetricPrefix + prefix
+	}
+	res := NewMetricContextWithPrefix(ctx, o.MeterController.Meter(o.DefaultLibraryName), prefix)
+	res.attrs = o.MetricAttributes
+	if canary && o.CanaryMetricPrefix == "" {
+		res.attrs = appendAttrs(res.attrs, []attribute.KeyValue{attribute.Bool(CanaryAttributeName, true)})
+	}
+	res.observerAttrs = res.attrs
+	res.limiter = o.Cardinality
+	res.preAggregate = o.PreAggregateMetrics
+	res.normalizeUnits = o.NormalizeUnits
+	res.emf = o.EMF
+	res.instruments = o.instruments
+	return res
 }
 
 func (o *Observer) MakeTracer() trace.Tracer {
@@ -4,8 +4,12 @@ import (
 	"context"
 	"github.com/Cyberax/argus-vision/visibility/logging"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	v1 "go.opentelemetry.io/proto/otlp/metrics/v1"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"strings"
@@ -41,7 +45,7 @@ func TestObserverWithMockCollector(t *testing.T) {
 	span.SetStatus(codes.Ok, "Everything's fine")
 	span.End()
 
-	obs.Shutdown(context.Background())
+	assert.NoError(t, obs.Shutdown(context.Background()))
 
 	spans, metrics := mc.Get()
 	sp1 := spans[0].GetScopeSpans()[0].GetSpans()[0]
@@ -58,17 +62,21 @@ func TestObserverWithMockCollector(t *testing.T) {
 	assert.Equal(t, "prod.hello_world_test2", sp1.Attributes[1].Key)
 	assert.Equal(t, 123.+321., sp1.Attributes[1].Value.GetDoubleValue())
 
-	assert.Empty(t, metrics)
-	//metricsMap := make(map[string]*v1.Metric)
-	//for _, m := range metrics[0].ScopeMetrics[0].Metrics {
-	//	metricsMap[m.Name] = m
-	//}
-	//
-	//m0 := metricsMap["prod.hello_world_test2_num"]
-	//assert.Equal(t, 2., m0.GetSum().GetDataPoints()[0].GetAsDouble())
-	//
-	//m1 := metricsMap["prod.hello_world_test2"]
-	//assert.Equal(t, 123.+321., m1.GetSum().GetDataPoints()[0].GetAsDouble())
+	// The metrics are flushed by the shutdown
+	metricsMap := make(map[string]*v1.Metric)
+	for _, rm := range metrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				metricsMap[m.Name] = m
+			}
+		}
+	}
+
+	m0 := metricsMap["prod.hello_world_test2_num"]
+	assert.Equal(t, 2., m0.GetSum().GetDataPoints()[0].GetAsDouble())
+
+	m1 := metricsMap["prod.hello_world_test2"]
+	assert.Equal(t, 123.+321., m1.GetSum().GetDataPoints()[0].GetAsDouble())
 }
 
 func TestObserverLogging(t *testing.T) {
@@ -115,3 +123,46 @@ func TestNoTracing(t *testing.T) {
 	metricCtx.Add(namedBytes, 123)
 	metricCtx.Close()
 }
+
+func TestScopedObserver(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, rec := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	reader := sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	billing := obs.Scoped("Billing", attribute.String("component", "billing"))
+	invoices := billing.Scoped("Invoices", attribute.String("shard", "7"))
+	// A no-op for the children
+	invoices.Shutdown(context.Background())
+
+	sp, ctx := BeginNewSpan(context.Background(), invoices, "MakeInvoice", WithMetrics())
+	logging.L(ctx).Info("Invoicing")
+	CleanupSpan(sp)
+
+	spans := rec.Get().Spans
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "Invoices", spans[0].InstrumentationScope().Name)
+	spanAttrs := attribute.NewSet(spans[0].Attributes()...)
+	component, _ := spanAttrs.Value("component")
+	assert.Equal(t, "billing", component.AsString())
+	shard, _ := spanAttrs.Value("shard")
+	assert.Equal(t, "7", shard.AsString())
+
+	assert.True(t, strings.Contains(sink.String(), `"logger":"Billing.Invoices.MakeInvoice"`))
+
+	rm := metricdata.ResourceMetrics{}
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	assert.Equal(t, "Invoices", rm.ScopeMetrics[0].Scope.Name)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		for _, p := range m.Data.(metricdata.Sum[float64]).DataPoints {
+			assert.Equal(t, attribute.NewSet(attribute.String("component", "billing"),
+				attribute.String("shard", "7")), p.Attributes)
+		}
+	}
+
+	// The parent is not affected
+	assert.Empty(t, obs.DefaultSpanAttributes)
+	assert.Equal(t, 1, len(billing.MetricAttributes))
+}
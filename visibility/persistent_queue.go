@@ -0,0 +1,395 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/metric"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPersistentQueueMaxBytes = 64 * 1024 * 1024
+	defaultQueueRetryInterval      = 5 * time.Second
+
+	queueFileSuffix = ".otlp"
+	tempFileSuffix  = ".tmp"
+)
+
+// persistentTraceClient sits between the OTLP exporter and its transport client. Each batch
+// of spans is first written into the spool directory, and then it's sent to the wrapped
+// client. The batches that fail to be sent stay on disk and are replayed in order by
+// a background goroutine, including after the restart of the process.
+//
+// The directory is bounded by maxBytes, the oldest batches are discarded once it's full.
+type persistentTraceClient struct {
+	inner         otlptrace.Client
+	dir           string
+	maxBytes      int64
+	retryInterval time.Duration
+	tel           *selfTelemetry
+	attrs         metric.MeasurementOption
+
+	mtx          sync.Mutex
+	nextSeq      uint64
+	backlog      map[uint64]int64 // Sequence number -> file size
+	backlogBytes int64
+
+	// Only one goroutine is sending the spooled batches at any time to preserve the order
+	drainMtx sync.Mutex
+	// Wakes up the retry loop once the collector is reachable again
+	wake chan struct{}
+
+	stop         chan struct{}
+	done         chan struct{}
+	stopOnce     sync.Once
+	registration metric.Registration
+}
+
+var _ otlptrace.Client = &persistentTraceClient{}
+
+func newPersistentTraceClient(inner otlptrace.Client, dir string, maxBytes int64,
+	tel *selfTelemetry, endpoint string) *persistentTraceClient {
+
+	if maxBytes <= 0 {
+		maxBytes = DefaultPersistentQueueMaxBytes
+	}
+	return &persistentTraceClient{
+		inner:         inner,
+		dir:           dir,
+		maxBytes:      maxBytes,
+		retryInterval: defaultQueueRetryInterval,
+		tel:           tel,
+		attrs: metric.WithAttributes(
+			attribute.String("signal", "traces"), attribute.String("endpoint", endpoint)),
+		backlog: make(map[uint64]int64),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start loads the batches left over from the previous runs and starts the retry loop.
+// The temporary files of the batches that were being written during a crash are removed.
+func (c *persistentTraceClient) Start(ctx context.Context) error {
+	err := os.MkdirAll(c.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), queueFileSuffix+tempFileSuffix) {
+			err = os.Remove(filepath.Join(c.dir, e.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		seq, ok := parseQueueFileName(e.Name())
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		c.backlog[seq] = info.Size()
+		c.backlogBytes += info.Size()
+		if seq >= c.nextSeq {
+			c.nextSeq = seq + 1
+		}
+	}
+
+	err = c.inner.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ins := c.tel.get(); ins != nil {
+		err = c.registerMetrics(ins.meter)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.retryLoop()
+
+	return nil
+}
+
+func (c *persistentTraceClient) registerMetrics(meter metric.Meter) error {
+	attrs := metric.WithAttributes(attribute.String("dir", c.dir))
+	batches, err := meter.Int64ObservableGauge("otel.exporter.queue.batches",
+		metric.WithUnit("{batch}"),
+		metric.WithDescription("Number of the span batches spooled on disk"))
+	if err != nil {
+		return err
+	}
+	size, err := meter.Int64ObservableGauge("otel.exporter.queue.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of the span batches spooled on disk"))
+	if err != nil {
+		return err
+	}
+
+	c.registration, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		files, bytes := c.Backlog()
+		o.ObserveInt64(batches, int64(files), attrs)
+		o.ObserveInt64(size, bytes, attrs)
+		return nil
+	}, batches, size)
+	return err
+}
+
+// Backlog returns the number of the batches and their total size on disk
+func (c *persistentTraceClient) Backlog() (int, int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.backlog), c.backlogBytes
+}
+
+// Stop makes one last attempt to send the spooled batches, the ones that can't be sent
+// stay on disk for the next run. Only the first call has any effect.
+func (c *persistentTraceClient) Stop(ctx context.Context) error {
+	var err error
+	c.stopOnce.Do(func() {
+		err = c.doStop(ctx)
+	})
+	return err
+}
+
+func (c *persistentTraceClient) doStop(ctx context.Context) error {
+	// The retry loop is not running if the client was never started
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+	}
+
+	if c.registration != nil {
+		_ = c.registration.Unregister()
+	}
+
+	c.drainMtx.Lock()
+	err := c.drain(ctx)
+	c.drainMtx.Unlock()
+	if err != nil {
+		otel.Handle(fmt.Errorf("spans are kept in %s: %w", c.dir, err))
+	}
+
+	return c.inner.Stop(ctx)
+}
+
+// UploadTraces spools the batch and tries to send it, the older batches are replayed by
+// the retry loop. The failures are not returned to the exporter because the spans are safe
+// on disk, they are reported to the otel.ErrorHandler instead.
+func (c *persistentTraceClient) UploadTraces(ctx context.Context, protoSpans []*tracepb.ResourceSpans) error {
+	data, err := proto.Marshal(&collectortracepb.ExportTraceServiceRequest{ResourceSpans: protoSpans})
+	if err != nil {
+		return err
+	}
+
+	seq, err := c.spool(data)
+	if err != nil {
+		return err
+	}
+
+	// If the retry loop is sending the backlog, then it will pick up our batch as well
+	if !c.drainMtx.TryLock() {
+		return nil
+	}
+	defer c.drainMtx.Unlock()
+
+	err = c.inner.UploadTraces(ctx, protoSpans)
+	if err != nil {
+		otel.Handle(fmt.Errorf("failed to send the spans, spooled them to %s: %w", c.dir, err))
+		return nil
+	}
+	c.countExported(protoSpans)
+
+	c.mtx.Lock()
+	c.removeLocked(seq)
+	pending := len(c.backlog)
+	c.mtx.Unlock()
+
+	// The collector is reachable, there's no need to wait for the next retry
+	if pending != 0 {
+		c.wakeUp()
+	}
+	return nil
+}
+
+func (c *persistentTraceClient) wakeUp() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+		// Already woken up
+	}
+}
+
+func (c *persistentTraceClient) retryLoop() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+
+		if files, _ := c.Backlog(); files == 0 {
+			continue
+		}
+		// Don't report the failures here, they are already reported by UploadTraces
+		c.drainMtx.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), c.retryInterval)
+		_ = c.drain(ctx)
+		cancel()
+		c.drainMtx.Unlock()
+	}
+}
+
+func (c *persistentTraceClient) spool(data []byte) (uint64, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	seq := c.nextSeq
+	c.nextSeq++
+
+	// Write into a temporary file first, so that a crash doesn't leave a partial batch
+	name := filepath.Join(c.dir, queueFileName(seq))
+	err := os.WriteFile(name+tempFileSuffix, data, 0600)
+	if err != nil {
+		return 0, err
+	}
+	err = os.Rename(name+tempFileSuffix, name)
+	if err != nil {
+		return 0, err
+	}
+
+	c.backlog[seq] = int64(len(data))
+	c.backlogBytes += int64(len(data))
+
+	// Evict the oldest batches
+	var dropped int
+	for _, s := range c.sortedBacklog() {
+		if c.backlogBytes <= c.maxBytes {
+			break
+		}
+		c.removeLocked(s)
+		dropped++
+	}
+	if dropped != 0 {
+		otel.Handle(fmt.Errorf("the span queue in %s is full, dropped %d oldest batches", c.dir, dropped))
+	}
+
+	return seq, nil
+}
+
+// drain sends the spooled batches in order, it must be called with drainMtx held
+func (c *persistentTraceClient) drain(ctx context.Context) error {
+	for {
+		c.mtx.Lock()
+		pending := c.sortedBacklog()
+		c.mtx.Unlock()
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		for _, seq := range pending {
+			data, err := os.ReadFile(filepath.Join(c.dir, queueFileName(seq)))
+			if os.IsNotExist(err) {
+				// Evicted in the meantime, or removed from under us
+				c.mtx.Lock()
+				c.removeLocked(seq)
+				c.mtx.Unlock()
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			req := &collectortracepb.ExportTraceServiceRequest{}
+			if err = proto.Unmarshal(data, req); err != nil {
+				// Corrupted file, there's no point in retrying it
+				otel.Handle(fmt.Errorf("dropping the corrupted span batch %d: %w", seq, err))
+			} else {
+				if err = c.inner.UploadTraces(ctx, req.ResourceSpans); err != nil {
+					return err
+				}
+				c.countExported(req.ResourceSpans)
+			}
+
+			c.mtx.Lock()
+			c.removeLocked(seq)
+			c.mtx.Unlock()
+		}
+	}
+}
+
+// countExported counts the spans once they are actually sent, the exporter only sees
+// them being spooled
+func (c *persistentTraceClient) countExported(protoSpans []*tracepb.ResourceSpans) {
+	ins := c.tel.get()
+	if ins == nil {
+		return
+	}
+	var count int
+	for _, rs := range protoSpans {
+		for _, ss := range rs.ScopeSpans {
+			count += len(ss.Spans)
+		}
+	}
+	ins.spansExported.Add(context.Background(), int64(count), c.attrs)
+}
+
+func (c *persistentTraceClient) sortedBacklog() []uint64 {
+	res := make([]uint64, 0, len(c.backlog))
+	for s := range c.backlog {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+func (c *persistentTraceClient) removeLocked(seq uint64) {
+	size, ok := c.backlog[seq]
+	if !ok {
+		return
+	}
+	delete(c.backlog, seq)
+	c.backlogBytes -= size
+	_ = os.Remove(filepath.Join(c.dir, queueFileName(seq)))
+}
+
+func queueFileName(seq uint64) string {
+	// Zero-padded to make the directory listing sorted
+	return fmt.Sprintf("%020d%s", seq, queueFileSuffix)
+}
+
+func parseQueueFileName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, queueFileSuffix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileSuffix), 10, 64)
+	return seq, err == nil
+}
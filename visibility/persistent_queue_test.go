@@ -0,0 +1,257 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type flakyTraceClient struct {
+	mtx      sync.Mutex
+	down     bool
+	uploaded []string
+}
+
+func (f *flakyTraceClient) Start(context.Context) error {
+	return nil
+}
+
+func (f *flakyTraceClient) Stop(context.Context) error {
+	return nil
+}
+
+func (f *flakyTraceClient) UploadTraces(_ context.Context, protoSpans []*tracepb.ResourceSpans) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.down {
+		return fmt.Errorf("collector is unreachable")
+	}
+	for _, rs := range protoSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, sp := range ss.Spans {
+				f.uploaded = append(f.uploaded, sp.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *flakyTraceClient) setDown(down bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.down = down
+}
+
+func (f *flakyTraceClient) getUploaded() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string{}, f.uploaded...)
+}
+
+func makeSpanBatch(name string) []*tracepb.ResourceSpans {
+	return []*tracepb.ResourceSpans{{ScopeSpans: []*tracepb.ScopeSpans{{
+		Spans: []*tracepb.Span{{Name: name}},
+	}}}}
+}
+
+func TestPersistentQueueReplay(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	ctx := context.Background()
+
+	inner := &flakyTraceClient{down: true}
+	client := newPersistentTraceClient(inner, dir, 0, &selfTelemetry{}, "")
+	assert.NoError(t, client.Start(ctx))
+
+	// The failures are not propagated, the spans are kept on disk
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("One")))
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Two")))
+	files, _ := client.Backlog()
+	assert.Equal(t, 2, files)
+	assert.Empty(t, inner.getUploaded())
+
+	// Restart the process, the backlog is picked up from the disk
+	assert.NoError(t, client.Stop(ctx))
+	client = newPersistentTraceClient(inner, dir, 0, &selfTelemetry{}, "")
+	assert.NoError(t, client.Start(ctx))
+	files, _ = client.Backlog()
+	assert.Equal(t, 2, files)
+
+	// The collector is back, the new batch is sent right away and the backlog is
+	// replayed in order in the background
+	inner.setDown(false)
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Three")))
+	assert.Equal(t, "Three", inner.getUploaded()[0])
+	assert.Eventually(t, func() bool {
+		files, _ := client.Backlog()
+		return files == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"Three", "One", "Two"}, inner.getUploaded())
+
+	_, bytes := client.Backlog()
+	assert.Equal(t, int64(0), bytes)
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries)
+
+	assert.NoError(t, client.Stop(ctx))
+}
+
+func TestPersistentQueueEviction(t *testing.T) {
+	ctx := context.Background()
+	// All the batches have the same size, the queue has room for two of them
+	batch, err := proto.Marshal(&collectortracepb.ExportTraceServiceRequest{
+		ResourceSpans: makeSpanBatch("One")})
+	assert.NoError(t, err)
+
+	inner := &flakyTraceClient{down: true}
+	client := newPersistentTraceClient(inner, t.TempDir(), int64(2*len(batch)), &selfTelemetry{}, "")
+	assert.NoError(t, client.Start(ctx))
+	defer client.Stop(ctx)
+
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("One")))
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Two")))
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Six")))
+	files, _ := client.Backlog()
+	assert.Equal(t, 2, files)
+
+	// The new batch is spooled before sending, so it also pushes out the oldest one
+	inner.setDown(false)
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Ten")))
+	assert.Eventually(t, func() bool {
+		return len(inner.getUploaded()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"Ten", "Six"}, inner.getUploaded())
+}
+
+func TestPersistentQueueSendsOnlyCurrentBatch(t *testing.T) {
+	ctx := context.Background()
+	inner := &flakyTraceClient{down: true}
+	client := newPersistentTraceClient(inner, t.TempDir(), 0, &selfTelemetry{}, "")
+	assert.NoError(t, client.Start(ctx))
+	defer client.Stop(ctx)
+
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("One")))
+
+	// The exporter doesn't wait for the backlog while the retry loop is busy with it
+	client.drainMtx.Lock()
+	inner.setDown(false)
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Two")))
+	assert.Empty(t, inner.getUploaded())
+	files, _ := client.Backlog()
+	assert.Equal(t, 2, files)
+	client.drainMtx.Unlock()
+
+	// The retry loop sends both batches in order once it gets to them
+	client.wakeUp()
+	assert.Eventually(t, func() bool {
+		return len(inner.getUploaded()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"One", "Two"}, inner.getUploaded())
+}
+
+func TestPersistentQueueMetrics(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	tel := &selfTelemetry{}
+	assert.NoError(t, tel.init(obs.MeterController))
+
+	ctx := context.Background()
+	client := newPersistentTraceClient(&flakyTraceClient{down: true}, t.TempDir(), 0, tel, "")
+	assert.NoError(t, client.Start(ctx))
+	defer client.Stop(ctx)
+
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("One")))
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Two")))
+
+	_, bytes := client.Backlog()
+	values := rec.Get()
+	assert.Equal(t, 2., values.Metrics["otel.exporter.queue.batches"])
+	assert.Equal(t, float64(bytes), values.Metrics["otel.exporter.queue.size"])
+}
+
+func TestPersistentQueueExporter(t *testing.T) {
+	collector := runMockCollector(t)
+	t.Cleanup(collector.Stop)
+
+	opts := NewBlindObserverOptions()
+	opts.LibraryName = "ArgusApp"
+	opts.TraceExporters = []TraceExporterOptions{
+		{Endpoint: collector.endpoint, PersistentQueueDir: t.TempDir()},
+	}
+
+	obs, err := NewObserver(zap.NewNop(), opts)
+	assert.NoError(t, err)
+
+	sp, _ := BeginNewSpan(context.Background(), obs, "SpooledSpan")
+	CleanupSpan(sp)
+	obs.Shutdown(context.Background())
+
+	spans, _ := collector.Get()
+	assert.Equal(t, []string{"SpooledSpan"}, spanNames(
+		[]*collectortracepb.ExportTraceServiceRequest{{ResourceSpans: spans}}))
+}
+
+func TestPersistentQueueRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// A crash in the middle of spooling leaves a temporary file behind
+	stale := filepath.Join(dir, queueFileName(7)+tempFileSuffix)
+	assert.NoError(t, os.WriteFile(stale, []byte("partial"), 0600))
+
+	inner := &flakyTraceClient{down: true}
+	client := newPersistentTraceClient(inner, dir, 0, &selfTelemetry{}, "")
+	assert.NoError(t, client.Start(ctx))
+	_, err := os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+
+	// A batch that disappears from the disk is forgotten instead of being retried forever
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Lost")))
+	assert.NoError(t, os.Remove(filepath.Join(dir, queueFileName(0))))
+	inner.setDown(false)
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Kept")))
+	assert.Eventually(t, func() bool {
+		files, _ := client.Backlog()
+		return files == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"Kept"}, inner.getUploaded())
+
+	// Stopping twice is fine
+	assert.NoError(t, client.Stop(ctx))
+	assert.NoError(t, client.Stop(ctx))
+
+	// And so is stopping a client that was never started
+	assert.NoError(t, newPersistentTraceClient(inner, dir, 0, &selfTelemetry{}, "").Stop(ctx))
+}
+
+func TestPersistentQueueCountsSentSpans(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	tel := &selfTelemetry{}
+	assert.NoError(t, tel.init(obs.MeterController))
+
+	ctx := context.Background()
+	inner := &flakyTraceClient{down: true}
+	client := newPersistentTraceClient(inner, t.TempDir(), 0, tel, "")
+	assert.NoError(t, client.Start(ctx))
+	defer client.Stop(ctx)
+
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("One")))
+	assert.Zero(t, rec.Get().Metrics["otel.exporter.spans.exported"])
+
+	inner.setDown(false)
+	assert.NoError(t, client.UploadTraces(ctx, makeSpanBatch("Two")))
+	assert.Eventually(t, func() bool {
+		return rec.Get().Metrics["otel.exporter.spans.exported"] == 2.
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -2,41 +2,68 @@ package visibility
 
 import (
 	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
 	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/metric/aggregation"
 	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"go.opentelemetry.io/otel/sdk/trace"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/atomic"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"sync"
 )
 
-func NewRecordingObserver(rootLogger *zap.Logger) (*Observer, *Recorder) {
+// NewRecordingObserver creates the Observer that keeps all the spans and metrics in memory,
+// the views can be used to customize the metrics (e.g. with HistogramBuckets.Views)
+func NewRecordingObserver(rootLogger *zap.Logger, views ...metric.View) (*Observer, *Recorder) {
+	return newRecordingObserver(rootLogger, metric.DefaultTemporalitySelector, views)
+}
+
+// NewDeltaRecordingObserver is like NewRecordingObserver, but all the metrics use the delta
+// temporality, so that each Recorder.Get returns only the values recorded since the previous call
+func NewDeltaRecordingObserver(rootLogger *zap.Logger, views ...metric.View) (*Observer, *Recorder) {
+	return newRecordingObserver(rootLogger, func(metric.InstrumentKind) metricdata.Temporality {
+		return metricdata.DeltaTemporality
+	}, views)
+}
+
+func newRecordingObserver(rootLogger *zap.Logger, temporality metric.TemporalitySelector,
+	views []metric.View) (*Observer, *Recorder) {
+
+	levels := logging.NewLevelControl(rootLogger)
 	res := &Observer{
-		Logger:           rootLogger,
+		Logger:           levels.WrapLogger(rootLogger),
 		LogFieldsForSpan: DatadogLogDerivation,
+
+		LogLevels:         levels,
+		Sampler:           NewSwitchableSampler(sdktrace.AlwaysSample()),
+		SlowSpanThreshold: atomic.NewDuration(0),
+		instruments:       &instrumentRegistry{},
 	}
 
 	tracerExp := &recordingSpanExporter{}
 
 	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSampler(res.Sampler),
 		sdktrace.WithSyncer(tracerExp),
 		sdktrace.WithIDGenerator(NewPredictableIdGen(123)),
 	)
 	res.TraceProvider = tp
 
-	exp := &recordingMetricExporter{}
+	exp := &recordingMetricExporter{temporality: temporality}
+	reader := metric.NewPeriodicReader(exp)
 	pusher := metric.NewMeterProvider(
-		metric.WithReader(metric.NewPeriodicReader(exp)),
+		metric.WithReader(reader),
+		metric.WithView(views...),
 	)
 
 	res.MeterController = pusher
+	res.metricReaders = []metric.Reader{reader}
 
-	res.Shutdown = func(ctx context.Context) {
-		_ = tp.Shutdown(ctx)
-		_ = pusher.ForceFlush(ctx)
-		_ = pusher.Shutdown(ctx)
+	res.Shutdown = func(ctx context.Context) error {
+		res.instruments.clear()
+		return multierr.Combine(tp.Shutdown(ctx), pusher.ForceFlush(ctx), pusher.Shutdown(ctx))
 	}
 
 	return res, &Recorder{
@@ -47,8 +74,11 @@ func NewRecordingObserver(rootLogger *zap.Logger) (*Observer, *Recorder) {
 }
 
 type Record struct {
+	// The sums of the counters and histograms, and the last values of the gauges
 	Metrics map[string]float64
-	Spans   []trace.ReadOnlySpan
+	// The histogram data points, for all the attribute sets
+	Histograms map[string][]metricdata.HistogramDataPoint[float64]
+	Spans      []trace.ReadOnlySpan
 }
 
 type Recorder struct {
@@ -66,10 +96,15 @@ func (r *Recorder) Get() Record {
 	defer r.metrics.mtx.Unlock()
 	res.Metrics = r.metrics.Sums
 	r.metrics.Sums = nil
+	res.Histograms = r.metrics.Histograms
+	r.metrics.Histograms = nil
 
 	if res.Metrics == nil {
 		res.Metrics = make(map[string]float64)
 	}
+	if res.Histograms == nil {
+		res.Histograms = make(map[string][]metricdata.HistogramDataPoint[float64])
+	}
 
 	r.tracer.mtx.Lock()
 	defer r.tracer.mtx.Unlock()
@@ -80,15 +115,17 @@ func (r *Recorder) Get() Record {
 }
 
 type recordingMetricExporter struct {
-	mtx sync.Mutex
+	mtx         sync.Mutex
+	temporality metric.TemporalitySelector
 
-	Sums map[string]float64
+	Sums       map[string]float64
+	Histograms map[string][]metricdata.HistogramDataPoint[float64]
 }
 
 var _ metric.Exporter = &recordingMetricExporter{}
 
 func (e *recordingMetricExporter) Temporality(kind metric.InstrumentKind) metricdata.Temporality {
-	return metric.DefaultTemporalitySelector(kind)
+	return e.temporality(kind)
 }
 
 func (e *recordingMetricExporter) Aggregation(kind metric.InstrumentKind) aggregation.Aggregation {
@@ -102,15 +139,39 @@ func (e *recordingMetricExporter) Export(ctx context.Context, metrics *metricdat
 	if e.Sums == nil {
 		e.Sums = make(map[string]float64)
 	}
+	if e.Histograms == nil {
+		e.Histograms = make(map[string][]metricdata.HistogramDataPoint[float64])
+	}
 
 	for _, scope := range metrics.ScopeMetrics {
 		for _, m := range scope.Metrics {
 			agg := m.Data
 
-			if sum, ok := agg.(*metricdata.Sum[float64]); ok {
+			switch sum := agg.(type) {
+			case metricdata.Sum[float64]:
 				for _, p := range sum.DataPoints {
 					e.Sums[m.Name] += p.Value
 				}
+			case metricdata.Sum[int64]:
+				for _, p := range sum.DataPoints {
+					e.Sums[m.Name] += float64(p.Value)
+				}
+			case metricdata.Histogram[float64]:
+				for _, p := range sum.DataPoints {
+					e.Sums[m.Name] += p.Sum
+				}
+				e.Histograms[m.Name] = append(e.Histograms[m.Name], sum.DataPoints...)
+			// Gauges are reported as the sum of their last values over all the attribute sets
+			case metricdata.Gauge[float64]:
+				e.Sums[m.Name] = 0
+				for _, p := range sum.DataPoints {
+					e.Sums[m.Name] += p.Value
+				}
+			case metricdata.Gauge[int64]:
+				e.Sums[m.Name] = 0
+				for _, p := range sum.DataPoints {
+					e.Sums[m.Name] += float64(p.Value)
+				}
 			}
 		}
 	}
@@ -14,7 +14,7 @@ import (
 func TestRecorder(t *testing.T) {
 	namedBytes := Named("hello_world_test2", UnitBytes)
 
-	obs, rec := NewRecordingObserver(zap.NewNop())
+	obs, rec := NewDeltaRecordingObserver(zap.NewNop())
 	defer obs.Shutdown(context.Background())
 
 	// Make sure that the recorder can be used multiple times
@@ -34,8 +34,7 @@ func TestRecorder(t *testing.T) {
 		span.End()
 
 		values := rec.Get()
-		//TODO: fix
-		//assert.Equal(t, 444., values.Metrics[namedBytes.Name])
+		assert.Equal(t, 444., values.Metrics[namedBytes.Name])
 
 		sp := values.Spans[0]
 		assert.True(t, sp.EndTime().Sub(sp.StartTime()) >= 10*time.Millisecond)
@@ -55,7 +54,7 @@ func TestRecorder(t *testing.T) {
 	histogram.Record(context.Background(), 123)
 	histogram.Record(context.Background(), 1)
 
-	//histo := rec.Get()
-	//TODO: fix
-	//assert.Equal(t, 124., histo.Metrics["Hist1"])
+	histo := rec.Get()
+	assert.Equal(t, 124., histo.Metrics["Hist1"])
+	assert.Equal(t, uint64(2), histo.Histograms["Hist1"][0].Count)
 }
@@ -0,0 +1,83 @@
+package visibility
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	// RequestIDHeader is the HTTP header with the request ID, it's also used as the
+	// gRPC metadata key (in lower case)
+	RequestIDHeader = "X-Request-Id"
+	// RequestIDBaggageKey is the baggage member with the request ID
+	RequestIDBaggageKey = "request_id"
+	// RequestIDAttributeName is the span attribute and the log field with the request ID
+	RequestIDAttributeName = "request_id"
+
+	// The incoming request IDs that are longer than this are replaced
+	maxRequestIDLength = 128
+)
+
+type requestIDContextKey struct{}
+
+// NewRequestID generates a new random request ID
+func NewRequestID() string {
+	return utils.MakeRandomStr(10)
+}
+
+// RequestIDFromContext returns the request ID stored by ContextWithRequestID, or the
+// one received in the baggage. An empty string is returned if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		return id
+	}
+	return baggage.FromContext(ctx).Member(RequestIDBaggageKey).Value()
+}
+
+// ContextWithRequestID stores the request ID in the context and in the baggage, so that
+// it's propagated to the downstream services. It's also added as the "request_id" field
+// to the context logger, and as the span attribute to the spans started in this context.
+func (o *Observer) ContextWithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDContextKey{}, id)
+
+	// Merge with the existing baggage, it can contain the canary flag
+	if mem, err := baggage.NewMember(RequestIDBaggageKey, id); err == nil {
+		if bg, err := baggage.FromContext(ctx).SetMember(mem); err == nil {
+			ctx = baggage.ContextWithBaggage(ctx, bg)
+		}
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String(RequestIDAttributeName, id))
+	return o.ContextWithLogger(ctx, "", zap.String(RequestIDAttributeName, id))
+}
+
+// incomingRequestID returns the request ID received from the client if it's
+// acceptable, and generates a new one otherwise
+func incomingRequestID(ctx context.Context, received string) string {
+	if isValidRequestID(received) {
+		return received
+	}
+	if id := RequestIDFromContext(ctx); isValidRequestID(id) {
+		return id
+	}
+	return NewRequestID()
+}
+
+// isValidRequestID only allows the IDs that can be safely logged and put into the baggage
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		valid := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == ':'
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package visibility
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDContext(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, rec := NewRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+
+	assert.Empty(t, RequestIDFromContext(context.Background()))
+
+	ctx := MarkAsCanary(context.Background(), true)
+	ctx = obs.ContextWithRequestID(ctx, "req-1")
+	assert.Equal(t, "req-1", RequestIDFromContext(ctx))
+	// The baggage is merged
+	assert.True(t, IsCanaryRequest(ctx))
+	assert.Equal(t, "req-1", RequestIDFromContext(MarkAsCanary(ctx, false)))
+
+	sp, ctx := BeginNewSpan(ctx, obs, "Work")
+	logging.L(ctx).Info("Working")
+	CleanupSpan(sp)
+
+	attrs := attribute.NewSet(rec.Get().Spans[0].Attributes()...)
+	id, _ := attrs.Value(RequestIDAttributeName)
+	assert.Equal(t, "req-1", id.AsString())
+	assert.True(t, strings.Contains(sink.String(), `"request_id":"req-1"`))
+
+	assert.Equal(t, 20, len(NewRequestID()))
+	assert.NotEqual(t, NewRequestID(), NewRequestID())
+}
+
+func TestHTTPRequestID(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	var seen []string
+	handler := NewHTTPMiddleware(obs)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, RequestIDFromContext(r.Context()))
+	}))
+
+	serve := func(requestID string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if requestID != "" {
+			req.Header.Set(RequestIDHeader, requestID)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Header().Get(RequestIDHeader)
+	}
+
+	assert.Equal(t, "ticket-42", serve("ticket-42"))
+	generated := serve("")
+	assert.Equal(t, 20, len(generated))
+	// The IDs that can't be safely logged are replaced
+	replaced := serve("bad id\n")
+	assert.NotEqual(t, "bad id\n", replaced)
+	assert.Equal(t, []string{"ticket-42", generated, replaced}, seen)
+
+	// The client sends the request ID to the server
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := &http.Client{Transport: NewRoundTripper(obs, nil)}
+
+	ctx := obs.ContextWithRequestID(context.Background(), "from-client")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, "from-client", resp.Header.Get(RequestIDHeader))
+}
+
+func TestGRPCRequestID(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	_, conn := dialInstrumented(t, obs)
+	client := collectortracepb.NewTraceServiceClient(conn)
+
+	var header metadata.MD
+	ctx := obs.ContextWithRequestID(context.Background(), "from-client")
+	_, err := client.Export(ctx, &collectortracepb.ExportTraceServiceRequest{}, grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"from-client"}, header.Get("x-request-id"))
+
+	// The server generates the ID if the client doesn't send it
+	_, err = client.Export(context.Background(), &collectortracepb.ExportTraceServiceRequest{},
+		grpc.Header(&header))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(header.Get("x-request-id")))
+	assert.Equal(t, 20, len(header.Get("x-request-id")[0]))
+}
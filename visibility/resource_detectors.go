@@ -0,0 +1,201 @@
+package visibility
+
+import (
+	"bufio"
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+)
+
+// The VCS information attributes are not (yet) a part of the semantic conventions
+const (
+	VcsRevisionKey = attribute.Key("vcs.revision")
+	VcsTimeKey     = attribute.Key("vcs.time")
+	VcsModifiedKey = attribute.Key("vcs.modified")
+)
+
+// ContainerDetector detects the container.id attribute from the cgroup information. The paths
+// can be changed from their default /proc/self values for testing.
+type ContainerDetector struct {
+	CgroupPath    string
+	MountInfoPath string
+}
+
+var _ resource.Detector = &ContainerDetector{}
+
+func NewContainerDetector() *ContainerDetector {
+	return &ContainerDetector{
+		CgroupPath:    "/proc/self/cgroup",
+		MountInfoPath: "/proc/self/mountinfo",
+	}
+}
+
+// The last path element of the cgroup v1, e.g.:
+// 12:pids:/kubepods/burstable/pod1f9a/cri-containerd-<id>.scope
+// 4:memory:/docker/<id>
+var cgroupContainerIdRe = regexp.MustCompile(`(?:^|[/:\-])([0-9a-f]{64})(?:\.scope)?$`)
+
+// The container runtime bind-mounts /etc/hostname and friends from the container directory, and
+// this is typically the only way to find the ID within the cgroup v2 namespace, e.g.:
+// 1235 1234 0:1 /var/lib/docker/containers/<id>/hostname /etc/hostname rw - ext4 /dev/sda1 rw
+var mountInfoContainerIdRe = regexp.MustCompile(`/containers/([0-9a-f]{64})/`)
+
+// Detect returns the resource with the container.id attribute, or nil if the process
+// doesn't seem to be running in a container.
+func (c *ContainerDetector) Detect(_ context.Context) (*resource.Resource, error) {
+	id, err := scanFileForMatch(c.CgroupPath, func(line string) string {
+		m := cgroupContainerIdRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			return ""
+		}
+		return m[1]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if id == "" {
+		id, err = scanFileForMatch(c.MountInfoPath, func(line string) string {
+			m := mountInfoContainerIdRe.FindStringSubmatch(line)
+			if m == nil {
+				return ""
+			}
+			return m[1]
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if id == "" {
+		return nil, nil
+	}
+	return resource.NewSchemaless(semconv.ContainerIDKey.String(id)), nil
+}
+
+// scanFileForMatch returns the first non-empty result of the matcher, a missing file is
+// not an error (we're simply not on Linux).
+func scanFileForMatch(path string, matcher func(line string) string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		res := matcher(scanner.Text())
+		if res != "" {
+			return res, nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// KubernetesDetector detects the pod information exposed through the downward API
+// as environment variables. The pod spec must contain something like:
+//
+//	env:
+//	  - name: K8S_POD_NAME
+//	    valueFrom: {fieldRef: {fieldPath: metadata.name}}
+//	  - name: K8S_POD_NAMESPACE
+//	    valueFrom: {fieldRef: {fieldPath: metadata.namespace}}
+//	  - name: K8S_POD_UID
+//	    valueFrom: {fieldRef: {fieldPath: metadata.uid}}
+//	  - name: K8S_NODE_NAME
+//	    valueFrom: {fieldRef: {fieldPath: spec.nodeName}}
+//
+// The variables without the K8S_ prefix (POD_NAME, POD_NAMESPACE, POD_UID, NODE_NAME)
+// are also supported.
+type KubernetesDetector struct {
+	Getenv func(key string) string
+}
+
+var _ resource.Detector = &KubernetesDetector{}
+
+func NewKubernetesDetector() *KubernetesDetector {
+	return &KubernetesDetector{Getenv: os.Getenv}
+}
+
+func (k *KubernetesDetector) Detect(_ context.Context) (*resource.Resource, error) {
+	lookup := func(names ...string) string {
+		for _, n := range names {
+			if v := strings.TrimSpace(k.Getenv(n)); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	var attrs []attribute.KeyValue
+	if v := lookup("K8S_POD_NAME", "POD_NAME"); v != "" {
+		attrs = append(attrs, semconv.K8SPodNameKey.String(v))
+	}
+	if v := lookup("K8S_POD_NAMESPACE", "K8S_NAMESPACE_NAME", "POD_NAMESPACE"); v != "" {
+		attrs = append(attrs, semconv.K8SNamespaceNameKey.String(v))
+	}
+	if v := lookup("K8S_POD_UID", "POD_UID"); v != "" {
+		attrs = append(attrs, semconv.K8SPodUIDKey.String(v))
+	}
+	if v := lookup("K8S_NODE_NAME", "NODE_NAME"); v != "" {
+		attrs = append(attrs, semconv.K8SNodeNameKey.String(v))
+	}
+
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	return resource.NewSchemaless(attrs...), nil
+}
+
+// BuildInfoDetector detects the service.version from the main module version and the VCS
+// information (revision, commit time and the "dirty" flag) embedded by the Go toolchain.
+type BuildInfoDetector struct {
+	ReadBuildInfo func() (*debug.BuildInfo, bool)
+}
+
+var _ resource.Detector = &BuildInfoDetector{}
+
+func NewBuildInfoDetector() *BuildInfoDetector {
+	return &BuildInfoDetector{ReadBuildInfo: debug.ReadBuildInfo}
+}
+
+func (b *BuildInfoDetector) Detect(_ context.Context) (*resource.Resource, error) {
+	info, ok := b.ReadBuildInfo()
+	if !ok || info == nil {
+		return nil, nil
+	}
+
+	var attrs []attribute.KeyValue
+	// The "(devel)" version is used for the binaries built from the checked out source tree
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		attrs = append(attrs, semconv.ServiceVersionKey.String(v))
+	}
+
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			attrs = append(attrs, VcsRevisionKey.String(s.Value))
+		case "vcs.time":
+			attrs = append(attrs, VcsTimeKey.String(s.Value))
+		case "vcs.modified":
+			attrs = append(attrs, VcsModifiedKey.Bool(s.Value == "true"))
+		}
+	}
+
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	return resource.NewSchemaless(attrs...), nil
+}
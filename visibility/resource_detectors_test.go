@@ -0,0 +1,114 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"runtime/debug"
+	"testing"
+)
+
+const dockerContainerId = "3c1a9f8e2b7d4a6c9e0f1b2d3c4a5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d"
+const kubeContainerId = "9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d4c3b2a1f0e9d8c"
+
+func resourceAttrs(res *resource.Resource) map[string]string {
+	attrs := make(map[string]string)
+	if res == nil {
+		return attrs
+	}
+	for _, kv := range res.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+func TestContainerDetector(t *testing.T) {
+	detect := func(cgroup, mountInfo string) map[string]string {
+		det := &ContainerDetector{CgroupPath: cgroup, MountInfoPath: mountInfo}
+		res, err := det.Detect(context.Background())
+		assert.NoError(t, err)
+		return resourceAttrs(res)
+	}
+
+	attrs := detect("testdata/cgroup_v1_docker", "testdata/mountinfo_host")
+	assert.Equal(t, dockerContainerId, attrs["container.id"])
+
+	attrs = detect("testdata/cgroup_v1_kubepods", "testdata/mountinfo_host")
+	assert.Equal(t, kubeContainerId, attrs["container.id"])
+
+	// Cgroup v2 namespaces hide the path, so the mountinfo is used
+	attrs = detect("testdata/cgroup_v2", "testdata/mountinfo_v2")
+	assert.Equal(t, dockerContainerId, attrs["container.id"])
+
+	// Not in a container
+	attrs = detect("testdata/cgroup_v2", "testdata/mountinfo_host")
+	assert.Empty(t, attrs)
+
+	// Not on Linux
+	attrs = detect("testdata/nonexistent", "testdata/nonexistent")
+	assert.Empty(t, attrs)
+}
+
+func TestKubernetesDetector(t *testing.T) {
+	env := map[string]string{
+		"K8S_POD_NAME":  "argus-7d4b9c-x2x5z",
+		"POD_NAMESPACE": "monitoring",
+		"K8S_POD_UID":   "5c7d3a1e-8f2b-4c6d-9e0a-1b2c3d4e5f60",
+		"NODE_NAME":     "ip-10-0-1-12",
+	}
+	det := &KubernetesDetector{Getenv: func(key string) string { return env[key] }}
+	res, err := det.Detect(context.Background())
+	assert.NoError(t, err)
+
+	attrs := resourceAttrs(res)
+	assert.Equal(t, "argus-7d4b9c-x2x5z", attrs["k8s.pod.name"])
+	assert.Equal(t, "monitoring", attrs["k8s.namespace.name"])
+	assert.Equal(t, "5c7d3a1e-8f2b-4c6d-9e0a-1b2c3d4e5f60", attrs["k8s.pod.uid"])
+	assert.Equal(t, "ip-10-0-1-12", attrs["k8s.node.name"])
+
+	det = &KubernetesDetector{Getenv: func(key string) string { return "" }}
+	res, err = det.Detect(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestBuildInfoDetector(t *testing.T) {
+	det := &BuildInfoDetector{ReadBuildInfo: func() (*debug.BuildInfo, bool) {
+		return &debug.BuildInfo{
+			Main: debug.Module{Path: "github.com/Cyberax/argus-app", Version: "v1.2.3"},
+			Settings: []debug.BuildSetting{
+				{Key: "-compiler", Value: "gc"},
+				{Key: "vcs.revision", Value: "e5d4c3b2a1f0"},
+				{Key: "vcs.time", Value: "2023-05-01T10:00:00Z"},
+				{Key: "vcs.modified", Value: "true"},
+			},
+		}, true
+	}}
+	res, err := det.Detect(context.Background())
+	assert.NoError(t, err)
+
+	attrs := resourceAttrs(res)
+	assert.Equal(t, "v1.2.3", attrs["service.version"])
+	assert.Equal(t, "e5d4c3b2a1f0", attrs["vcs.revision"])
+	assert.Equal(t, "2023-05-01T10:00:00Z", attrs["vcs.time"])
+	assert.Equal(t, "true", attrs["vcs.modified"])
+
+	// Development builds don't have a meaningful version
+	det = &BuildInfoDetector{ReadBuildInfo: func() (*debug.BuildInfo, bool) {
+		return &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}, true
+	}}
+	res, err = det.Detect(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestDefaultOptionsWithDetectors(t *testing.T) {
+	t.Setenv("K8S_POD_NAME", "argus-pod")
+
+	opts, err := NewDefaultObserverOptions("ArgusApp", "TracedDB", "alpha")
+	assert.NoError(t, err)
+
+	attrs := resourceAttrs(opts.Resource)
+	assert.Equal(t, "argus-pod", attrs["k8s.pod.name"])
+	assert.Equal(t, "TracedDB", attrs["service.name"])
+}
@@ -0,0 +1,280 @@
+package visibility
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/atomic"
+	"math"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RuntimeInstrumentationName is the instrumentation scope used for the Go runtime metrics
+const RuntimeInstrumentationName = "github.com/Cyberax/argus-vision/runtime"
+
+// runtimeScalarMetric maps one or more runtime/metrics values into a single instrument,
+// the values of all the sources are summed together.
+type runtimeScalarMetric struct {
+	name       string
+	unit       string
+	desc       string
+	cumulative bool
+	sources    []string
+}
+
+// runtimeHistogramMetric maps a runtime/metrics histogram of durations into a histogram
+// in nanoseconds
+type runtimeHistogramMetric struct {
+	name   string
+	desc   string
+	source string
+}
+
+// The names follow the OTel semantic conventions for the Go runtime, see:
+// https://github.com/open-telemetry/opentelemetry-specification/blob/main/specification/metrics/semantic_conventions/runtime-environment-metrics.md
+// The heap memory classes are grouped the same way as in runtime.MemStats
+var runtimeScalarMetrics = []runtimeScalarMetric{
+	{name: "process.runtime.go.goroutines", unit: "{goroutine}",
+		desc:    "Number of goroutines that currently exist",
+		sources: []string{"/sched/goroutines:goroutines"}},
+	{name: "process.runtime.go.cgo.calls", unit: "{call}", cumulative: true,
+		desc:    "Number of cgo calls made by the current process",
+		sources: []string{"/cgo/go-to-c-calls:calls"}},
+	{name: "process.runtime.go.mem.heap_alloc", unit: "By",
+		desc:    "Bytes of allocated heap objects",
+		sources: []string{"/memory/classes/heap/objects:bytes"}},
+	{name: "process.runtime.go.mem.heap_inuse", unit: "By",
+		desc:    "Bytes in in-use spans",
+		sources: []string{"/memory/classes/heap/objects:bytes", "/memory/classes/heap/unused:bytes"}},
+	{name: "process.runtime.go.mem.heap_idle", unit: "By",
+		desc:    "Bytes in idle (unused) spans",
+		sources: []string{"/memory/classes/heap/free:bytes", "/memory/classes/heap/released:bytes"}},
+	{name: "process.runtime.go.mem.heap_released", unit: "By",
+		desc:    "Bytes of idle spans whose physical memory has been returned to the OS",
+		sources: []string{"/memory/classes/heap/released:bytes"}},
+	{name: "process.runtime.go.mem.heap_objects", unit: "{object}",
+		desc:    "Number of allocated heap objects",
+		sources: []string{"/gc/heap/objects:objects"}},
+	{name: "process.runtime.go.gc.goal", unit: "By",
+		desc:    "Heap size target for the end of the GC cycle",
+		sources: []string{"/gc/heap/goal:bytes"}},
+	{name: "process.runtime.go.gc.count", unit: "{gc_cycle}", cumulative: true,
+		desc:    "Number of completed garbage collection cycles",
+		sources: []string{"/gc/cycles/total:gc-cycles"}},
+}
+
+var runtimeHistogramMetrics = []runtimeHistogramMetric{
+	{name: "process.runtime.go.gc.pause_ns",
+		desc:   "Amount of nanoseconds in GC stop-the-world pauses",
+		source: "/gc/pauses:seconds"},
+	{name: "process.runtime.go.sched.latency_ns",
+		desc:   "Amount of nanoseconds goroutines have spent runnable before running",
+		source: "/sched/latencies:seconds"},
+}
+
+// The runtime histograms have hundreds of buckets, which is way too much for most of the
+// backends. So their buckets are merged into these bounds, in nanoseconds.
+var runtimeHistogramBounds = []float64{
+	1e3, 2.5e3, 5e3, 1e4, 2.5e4, 5e4, 1e5, 2.5e5, 5e5,
+	1e6, 2.5e6, 5e6, 1e7, 2.5e7, 5e7, 1e8, 2.5e8, 5e8, 1e9,
+}
+
+type runtimeMetricsCollector struct {
+	mtx     sync.Mutex
+	samples []metrics.Sample
+	indices map[string]int
+
+	scalars   []runtimeScalarMetric
+	scalarObs []metric.Int64Observable
+}
+
+// runtimeHistogramProducer publishes the runtime histograms as the cumulative histograms,
+// the OTel API has no asynchronous histogram instruments
+type runtimeHistogramProducer struct {
+	mtx        sync.Mutex
+	samples    []metrics.Sample
+	histograms []runtimeHistogramMetric
+	// The counts at the start, the histograms only cover the values observed since then
+	baseline  [][]uint64
+	startTime time.Time
+
+	stopped atomic.Bool
+}
+
+var _ sdkmetric.Producer = &runtimeHistogramProducer{}
+
+// runtimeRegistration also stops the histogram producer, the readers can't unregister it
+type runtimeRegistration struct {
+	metric.Registration
+	producer *runtimeHistogramProducer
+}
+
+func (r *runtimeRegistration) Unregister() error {
+	r.producer.stopped.Store(true)
+	return r.Registration.Unregister()
+}
+
+// StartRuntimeMetrics publishes the Go runtime statistics (goroutines, heap, GC pauses,
+// scheduler latency and cgo calls). The values are read from runtime/metrics during each
+// collection cycle, so no background goroutine is needed. The GC pauses and the scheduler
+// latencies are the cumulative histograms since this call, they are only published through
+// the metric readers created by the Observer. Use the returned registration to stop
+// publishing the metrics.
+func (o *Observer) StartRuntimeMetrics() (metric.Registration, error) {
+	meter := o.MeterController.Meter(RuntimeInstrumentationName)
+
+	col := &runtimeMetricsCollector{indices: make(map[string]int)}
+
+	// Not all the runtime metrics are available in all the Go versions
+	supported := make(map[string]metrics.ValueKind)
+	for _, d := range metrics.All() {
+		supported[d.Name] = d.Kind
+	}
+	addSample := func(name string, kind metrics.ValueKind) bool {
+		if supported[name] != kind {
+			return false
+		}
+		if _, ok := col.indices[name]; !ok {
+			col.indices[name] = len(col.samples)
+			col.samples = append(col.samples, metrics.Sample{Name: name})
+		}
+		return true
+	}
+
+	var instruments []metric.Observable
+
+outer:
+	for _, sm := range runtimeScalarMetrics {
+		for _, src := range sm.sources {
+			if !addSample(src, metrics.KindUint64) {
+				continue outer
+			}
+		}
+
+		var inst metric.Int64Observable
+		var err error
+		if sm.cumulative {
+			inst, err = meter.Int64ObservableCounter(sm.name,
+				metric.WithUnit(sm.unit), metric.WithDescription(sm.desc))
+		} else {
+			inst, err = meter.Int64ObservableUpDownCounter(sm.name,
+				metric.WithUnit(sm.unit), metric.WithDescription(sm.desc))
+		}
+		if err != nil {
+			return nil, err
+		}
+		col.scalars = append(col.scalars, sm)
+		col.scalarObs = append(col.scalarObs, inst)
+		instruments = append(instruments, inst)
+	}
+
+	reg, err := meter.RegisterCallback(col.observe, instruments...)
+	if err != nil {
+		return nil, err
+	}
+
+	producer := &runtimeHistogramProducer{}
+	for _, hm := range runtimeHistogramMetrics {
+		if supported[hm.source] != metrics.KindFloat64Histogram {
+			continue
+		}
+		producer.histograms = append(producer.histograms, hm)
+		producer.samples = append(producer.samples, metrics.Sample{Name: hm.source})
+	}
+	metrics.Read(producer.samples)
+	producer.startTime = time.Now()
+	for _, sample := range producer.samples {
+		counts := sample.Value.Float64Histogram().Counts
+		producer.baseline = append(producer.baseline, append([]uint64{}, counts...))
+	}
+	for _, reader := range o.metricReaders {
+		reader.RegisterProducer(producer)
+	}
+
+	return &runtimeRegistration{Registration: reg, producer: producer}, nil
+}
+
+func (c *runtimeMetricsCollector) observe(_ context.Context, observer metric.Observer) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	metrics.Read(c.samples)
+
+	for i, sm := range c.scalars {
+		var val uint64
+		for _, src := range sm.sources {
+			val += c.samples[c.indices[src]].Value.Uint64()
+		}
+		observer.ObserveInt64(c.scalarObs[i], int64(val))
+	}
+
+	return nil
+}
+
+func (p *runtimeHistogramProducer) Produce(context.Context) ([]metricdata.ScopeMetrics, error) {
+	if p.stopped.Load() || len(p.histograms) == 0 {
+		return nil, nil
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	metrics.Read(p.samples)
+	now := time.Now()
+
+	res := make([]metricdata.Metrics, 0, len(p.histograms))
+	for i, hm := range p.histograms {
+		hist := p.samples[i].Value.Float64Histogram()
+		dp := metricdata.HistogramDataPoint[float64]{
+			StartTime:    p.startTime,
+			Time:         now,
+			Bounds:       runtimeHistogramBounds,
+			BucketCounts: make([]uint64, len(runtimeHistogramBounds)+1),
+		}
+		for b, cnt := range hist.Counts {
+			if b < len(p.baseline[i]) {
+				cnt -= p.baseline[i][b]
+			}
+			if cnt == 0 {
+				continue
+			}
+			// The runtime bucket b covers the range of [Buckets[b], Buckets[b+1]) in seconds
+			lower, upper := hist.Buckets[b]*1e9, hist.Buckets[b+1]*1e9
+			dp.Count += cnt
+			dp.Sum += float64(cnt) * runtimeBucketMidpoint(lower, upper)
+			dp.BucketCounts[sort.SearchFloat64s(runtimeHistogramBounds, lower)] += cnt
+		}
+
+		res = append(res, metricdata.Metrics{
+			Name:        hm.name,
+			Description: hm.desc,
+			Unit:        "ns",
+			Data: metricdata.Histogram[float64]{
+				DataPoints:  []metricdata.HistogramDataPoint[float64]{dp},
+				Temporality: metricdata.CumulativeTemporality,
+			},
+		})
+	}
+
+	return []metricdata.ScopeMetrics{{
+		Scope:   instrumentation.Scope{Name: RuntimeInstrumentationName},
+		Metrics: res,
+	}}, nil
+}
+
+// runtimeBucketMidpoint estimates the values in the runtime bucket, the sums of the histograms
+// are approximate because the runtime doesn't keep them
+func runtimeBucketMidpoint(lower, upper float64) float64 {
+	if math.IsInf(lower, -1) || lower < 0 {
+		lower = 0
+	}
+	if math.IsInf(upper, 1) {
+		return lower
+	}
+	return (lower + upper) / 2
+}
@@ -0,0 +1,95 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+	"math"
+	"runtime"
+	"testing"
+)
+
+func TestRuntimeMetrics(t *testing.T) {
+	obs, rec := NewDeltaRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	reg, err := obs.StartRuntimeMetrics()
+	assert.NoError(t, err)
+
+	runtime.GC()
+	values := rec.Get()
+
+	assert.True(t, values.Metrics["process.runtime.go.goroutines"] >= 1)
+	assert.True(t, values.Metrics["process.runtime.go.mem.heap_alloc"] > 0)
+	assert.True(t, values.Metrics["process.runtime.go.mem.heap_objects"] > 0)
+	assert.True(t, values.Metrics["process.runtime.go.gc.count"] >= 1)
+	// At least one GC pause must be in the histogram
+	pauses := values.Histograms["process.runtime.go.gc.pause_ns"]
+	assert.Equal(t, 1, len(pauses))
+	assert.True(t, pauses[0].Count >= 1)
+	assert.True(t, pauses[0].Sum > 0)
+	assert.Equal(t, runtimeHistogramBounds, pauses[0].Bounds)
+	var bucketed uint64
+	for _, cnt := range pauses[0].BucketCounts {
+		bucketed += cnt
+	}
+	assert.Equal(t, pauses[0].Count, bucketed)
+	assert.Equal(t, 1, len(values.Histograms["process.runtime.go.sched.latency_ns"]))
+
+	// Once unregistered, nothing is published anymore
+	assert.NoError(t, reg.Unregister())
+	values = rec.Get()
+	assert.Equal(t, 0., values.Metrics["process.runtime.go.goroutines"])
+	assert.Empty(t, values.Histograms)
+}
+
+func TestRuntimeHistogramsWithSeveralReaders(t *testing.T) {
+	obs, _ := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	first, second := sdkmetric.NewManualReader(), sdkmetric.NewManualReader()
+	obs.MeterController = sdkmetric.NewMeterProvider(sdkmetric.WithReader(first), sdkmetric.WithReader(second))
+	obs.metricReaders = []sdkmetric.Reader{first, second}
+
+	reg, err := obs.StartRuntimeMetrics()
+	assert.NoError(t, err)
+	defer reg.Unregister()
+
+	pauses := func(reader sdkmetric.Reader) uint64 {
+		rm := metricdata.ResourceMetrics{}
+		assert.NoError(t, reader.Collect(context.Background(), &rm))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name == "process.runtime.go.gc.pause_ns" {
+					return m.Data.(metricdata.Histogram[float64]).DataPoints[0].Count
+				}
+			}
+		}
+		return 0
+	}
+
+	runtime.GC()
+	// The histograms are cumulative, so the readers don't split the pauses between them
+	counted := pauses(first)
+	assert.True(t, counted >= 1)
+	assert.True(t, pauses(second) >= counted)
+	assert.True(t, pauses(first) >= counted)
+}
+
+func TestRuntimeBucketMidpoint(t *testing.T) {
+	assert.Equal(t, 1500., runtimeBucketMidpoint(1000, 2000))
+	// The unbounded buckets are estimated by their finite bound
+	assert.Equal(t, 1e9, runtimeBucketMidpoint(1e9, math.Inf(1)))
+	assert.Equal(t, 500., runtimeBucketMidpoint(math.Inf(-1), 1000))
+}
+
+func TestRuntimeMetricsWithBlindObserver(t *testing.T) {
+	opts := NewBlindObserverOptions()
+	opts.RuntimeMetrics = true
+
+	obs, err := NewObserver(zap.NewNop(), opts)
+	assert.NoError(t, err)
+	obs.Shutdown(context.Background())
+}
@@ -0,0 +1,239 @@
+package visibility
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/aggregation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	uberatomic "go.uber.org/atomic"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SelfTelemetryInstrumentationName is the instrumentation scope for the metrics describing
+// the health of the telemetry pipeline itself
+const SelfTelemetryInstrumentationName = "github.com/Cyberax/argus-vision/telemetry"
+
+const (
+	// At most errorLogBurst OTel errors of the same class (see errorClass) are logged
+	// within each errorLogInterval
+	errorLogInterval = time.Minute
+	errorLogBurst    = 10
+
+	maxErrorClassLen = 80
+)
+
+// selfTelemetry holds the self-telemetry instruments. The exporters are created before
+// the MeterProvider that they are feeding, so the instruments are attached later and
+// nothing is recorded until then.
+type selfTelemetry struct {
+	instruments atomic.Value // *selfInstruments
+}
+
+type selfInstruments struct {
+	meter           metric.Meter
+	errors          metric.Int64Counter
+	spansExported   metric.Int64Counter
+	spansDropped    metric.Int64Counter
+	metricExports   metric.Int64Counter
+	metricFailures  metric.Int64Counter
+	exportDurations metric.Float64Histogram
+}
+
+func (s *selfTelemetry) init(mp metric.MeterProvider) error {
+	meter := mp.Meter(SelfTelemetryInstrumentationName)
+
+	var err error
+	ins := &selfInstruments{meter: meter}
+	if ins.errors, err = meter.Int64Counter("otel.errors", metric.WithUnit("{error}"),
+		metric.WithDescription("Number of the errors reported to the OTel error handler")); err != nil {
+		return err
+	}
+	if ins.spansExported, err = meter.Int64Counter("otel.exporter.spans.exported", metric.WithUnit("{span}"),
+		metric.WithDescription("Number of the spans successfully exported")); err != nil {
+		return err
+	}
+	if ins.spansDropped, err = meter.Int64Counter("otel.exporter.spans.dropped", metric.WithUnit("{span}"),
+		metric.WithDescription("Number of the spans that failed to be exported")); err != nil {
+		return err
+	}
+	if ins.metricExports, err = meter.Int64Counter("otel.exporter.metrics.exports", metric.WithUnit("{export}"),
+		metric.WithDescription("Number of the metric export attempts")); err != nil {
+		return err
+	}
+	if ins.metricFailures, err = meter.Int64Counter("otel.exporter.metrics.failures", metric.WithUnit("{export}"),
+		metric.WithDescription("Number of the failed metric exports")); err != nil {
+		return err
+	}
+	if ins.exportDurations, err = meter.Float64Histogram("otel.exporter.duration", metric.WithUnit(UnitSeconds),
+		metric.WithDescription("Duration of the export calls")); err != nil {
+		return err
+	}
+
+	s.instruments.Store(ins)
+	return nil
+}
+
+func (s *selfTelemetry) get() *selfInstruments {
+	ins, _ := s.instruments.Load().(*selfInstruments)
+	return ins
+}
+
+// newErrorHandler creates the OTel error handler that logs the errors with rate limiting,
+// and counts them in the otel.errors metric.
+func newErrorHandler(logger *zap.Logger, tel *selfTelemetry) otel.ErrorHandler {
+	limited := logger.Named("otel").WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(core, errorLogInterval, errorLogBurst, 0)
+	}))
+
+	return otel.ErrorHandlerFunc(func(err error) {
+		if ins := tel.get(); ins != nil {
+			ins.errors.Add(context.Background(), 1)
+		}
+		// The sampler keys on the message, so the different errors are limited separately
+		limited.Error("OpenTelemetry error: "+errorClass(err), zap.Error(err))
+	})
+}
+
+// errorClass returns the stable part of the error text: the text before the first ":"
+// (the wrapped errors usually follow it), with the numbers replaced by "#" so that the
+// counts and addresses don't make every error unique
+func errorClass(err error) string {
+	msg, _, _ := strings.Cut(err.Error(), ":")
+	if len(msg) > maxErrorClassLen {
+		msg = msg[:maxErrorClassLen]
+	}
+
+	var res strings.Builder
+	inNumber := false
+	for _, r := range msg {
+		isDigit := r >= '0' && r <= '9'
+		if !isDigit {
+			res.WriteRune(r)
+		} else if !inNumber {
+			res.WriteByte('#')
+		}
+		inNumber = isDigit
+	}
+	return res.String()
+}
+
+// instrumentedSpanExporter counts the exported and dropped spans
+type instrumentedSpanExporter struct {
+	sdktrace.SpanExporter
+	tel   *selfTelemetry
+	attrs metric.MeasurementOption
+
+	// The spans waiting in the queue of the BatchSpanProcessor, see boundedSpanProcessor
+	queued *uberatomic.Int64
+
+	// The spans are only spooled by a successful export, the persistent queue
+	// counts them once they are sent
+	spooled bool
+}
+
+func newInstrumentedSpanExporter(exp sdktrace.SpanExporter, tel *selfTelemetry,
+	endpoint string) *instrumentedSpanExporter {
+
+	return &instrumentedSpanExporter{
+		SpanExporter: exp,
+		tel:          tel,
+		queued:       uberatomic.NewInt64(0),
+		attrs: metric.WithAttributes(
+			attribute.String("signal", "traces"), attribute.String("endpoint", endpoint)),
+	}
+}
+
+func (e *instrumentedSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	// The spans have left the queue
+	e.queued.Sub(int64(len(spans)))
+
+	start := time.Now()
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+
+	if ins := e.tel.get(); ins != nil {
+		ins.exportDurations.Record(context.Background(), time.Since(start).Seconds(), e.attrs)
+		if err != nil {
+			ins.spansDropped.Add(context.Background(), int64(len(spans)), e.attrs)
+		} else if !e.spooled {
+			ins.spansExported.Add(context.Background(), int64(len(spans)), e.attrs)
+		}
+	}
+	return err
+}
+
+// boundedSpanProcessor drops the spans that would overflow the queue of the wrapped
+// BatchSpanProcessor and counts them as dropped, the BatchSpanProcessor drops them silently.
+// The spans are in the queue until they reach the instrumentedSpanExporter.
+type boundedSpanProcessor struct {
+	sdktrace.SpanProcessor
+	exporter *instrumentedSpanExporter
+	maxQueue int64
+}
+
+func newBoundedSpanProcessor(bsp sdktrace.SpanProcessor, exporter *instrumentedSpanExporter,
+	maxQueue int) *boundedSpanProcessor {
+
+	return &boundedSpanProcessor{SpanProcessor: bsp, exporter: exporter, maxQueue: int64(maxQueue)}
+}
+
+func (p *boundedSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	// The BatchSpanProcessor ignores the spans that are not sampled
+	if s.SpanContext().IsSampled() {
+		if p.exporter.queued.Inc() > p.maxQueue {
+			p.exporter.queued.Dec()
+			if ins := p.exporter.tel.get(); ins != nil {
+				ins.spansDropped.Add(context.Background(), 1, p.exporter.attrs)
+			}
+			return
+		}
+	}
+	p.SpanProcessor.OnEnd(s)
+}
+
+// instrumentedMetricExporter counts the metric exports and their failures
+type instrumentedMetricExporter struct {
+	sdkmetric.Exporter
+	tel   *selfTelemetry
+	attrs metric.MeasurementOption
+}
+
+func newInstrumentedMetricExporter(exp sdkmetric.Exporter, tel *selfTelemetry,
+	endpoint string) *instrumentedMetricExporter {
+
+	return &instrumentedMetricExporter{
+		Exporter: exp,
+		tel:      tel,
+		attrs: metric.WithAttributes(
+			attribute.String("signal", "metrics"), attribute.String("endpoint", endpoint)),
+	}
+}
+
+func (e *instrumentedMetricExporter) Temporality(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+	return e.Exporter.Temporality(kind)
+}
+
+func (e *instrumentedMetricExporter) Aggregation(kind sdkmetric.InstrumentKind) aggregation.Aggregation {
+	return e.Exporter.Aggregation(kind)
+}
+
+func (e *instrumentedMetricExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	start := time.Now()
+	err := e.Exporter.Export(ctx, rm)
+
+	if ins := e.tel.get(); ins != nil {
+		ins.exportDurations.Record(context.Background(), time.Since(start).Seconds(), e.attrs)
+		ins.metricExports.Add(context.Background(), 1, e.attrs)
+		if err != nil {
+			ins.metricFailures.Add(context.Background(), 1, e.attrs)
+		}
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package visibility
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"log"
+	"strings"
+	"testing"
+)
+
+type failingSpanExporter struct {
+	recordingSpanExporter
+}
+
+func (f *failingSpanExporter) ExportSpans(context.Context, []sdktrace.ReadOnlySpan) error {
+	return fmt.Errorf("collector is down")
+}
+
+type failingMetricExporter struct {
+	recordingMetricExporter
+}
+
+func (f *failingMetricExporter) Export(context.Context, *metricdata.ResourceMetrics) error {
+	return fmt.Errorf("collector is down")
+}
+
+func TestErrorHandlerRateLimiting(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	tel := &selfTelemetry{}
+	assert.NoError(t, tel.init(obs.MeterController))
+
+	sink, logger := logging.NewMemorySinkLogger()
+	handler := newErrorHandler(logger, tel)
+	for i := 0; i < 25; i++ {
+		handler.Handle(fmt.Errorf("export failed %d", i))
+	}
+
+	// The different errors are limited separately
+	handler.Handle(fmt.Errorf("queue is full: %d spans", 100))
+
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	assert.Equal(t, errorLogBurst+1, len(lines))
+	assert.Equal(t, `{"level":"error","logger":"otel","msg":"OpenTelemetry error: export failed #",`+
+		`"error":"export failed 0"}`, lines[0])
+	assert.Equal(t, `{"level":"error","logger":"otel","msg":"OpenTelemetry error: queue is full",`+
+		`"error":"queue is full: 100 spans"}`, lines[errorLogBurst])
+
+	// All the errors are counted, even if they are not logged
+	assert.Equal(t, 26., rec.Get().Metrics["otel.errors"])
+}
+
+func TestObserverInstallsErrorHandler(t *testing.T) {
+	// The global handler delegates to the installed one, so it can't be restored
+	// directly: it would delegate to itself
+	defer otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Print(err)
+	}))
+
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, err := NewObserver(logger, NewBlindObserverOptions())
+	assert.NoError(t, err)
+	obs.Shutdown(context.Background())
+
+	otel.Handle(fmt.Errorf("something broke"))
+	assert.True(t, strings.Contains(sink.String(), `"error":"something broke"`))
+
+	// The global handler is left alone on request
+	otherSink, otherLogger := logging.NewMemorySinkLogger()
+	opts := NewBlindObserverOptions()
+	opts.KeepErrorHandler = true
+	obs, err = NewObserver(otherLogger, opts)
+	assert.NoError(t, err)
+	defer obs.Shutdown(context.Background())
+
+	otel.Handle(fmt.Errorf("nobody is listening"))
+	assert.Empty(t, otherSink.String())
+	assert.True(t, strings.Contains(sink.String(), `"error":"nobody is listening"`))
+}
+
+func TestInstrumentedExporters(t *testing.T) {
+	obs, rec := NewRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	tel := &selfTelemetry{}
+	good := newInstrumentedSpanExporter(&recordingSpanExporter{}, tel, "good:4317")
+	bad := newInstrumentedSpanExporter(&failingSpanExporter{}, tel, "bad:4317")
+
+	spans := tracetest.SpanStubs{{Name: "One"}, {Name: "Two"}}.Snapshots()
+
+	// Nothing is recorded before the instruments are ready
+	assert.NoError(t, good.ExportSpans(context.Background(), spans))
+	assert.NoError(t, tel.init(obs.MeterController))
+
+	assert.NoError(t, good.ExportSpans(context.Background(), spans))
+	assert.Error(t, bad.ExportSpans(context.Background(), spans))
+	assert.Error(t, bad.ExportSpans(context.Background(), spans[:1]))
+
+	badMetrics := newInstrumentedMetricExporter(&failingMetricExporter{}, tel, "bad:4317")
+	assert.Error(t, badMetrics.Export(context.Background(), &metricdata.ResourceMetrics{}))
+
+	values := rec.Get()
+	assert.Equal(t, 2., values.Metrics["otel.exporter.spans.exported"])
+	assert.Equal(t, 3., values.Metrics["otel.exporter.spans.dropped"])
+	assert.Equal(t, 1., values.Metrics["otel.exporter.metrics.exports"])
+	assert.Equal(t, 1., values.Metrics["otel.exporter.metrics.failures"])
+}
+
+type countingSpanProcessor struct {
+	sdktrace.SpanProcessor
+	ended int
+}
+
+func (c *countingSpanProcessor) OnEnd(sdktrace.ReadOnlySpan) {
+	c.ended++
+}
+
+func TestBoundedSpanProcessor(t *testing.T) {
+	obs, rec := NewDeltaRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	tel := &selfTelemetry{}
+	assert.NoError(t, tel.init(obs.MeterController))
+
+	exporter := newInstrumentedSpanExporter(&recordingSpanExporter{}, tel, "collector:4317")
+	inner := &countingSpanProcessor{}
+	processor := newBoundedSpanProcessor(inner, exporter, 2)
+
+	sampled := tracetest.SpanStub{SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+		TraceFlags: trace.FlagsSampled})}.Snapshot()
+	unsampled := tracetest.SpanStub{}.Snapshot()
+
+	// The third span would overflow the queue
+	for i := 0; i < 3; i++ {
+		processor.OnEnd(sampled)
+	}
+	// The spans that are not sampled never get into the queue
+	processor.OnEnd(unsampled)
+	assert.Equal(t, 3, inner.ended)
+	assert.Equal(t, 1., rec.Get().Metrics["otel.exporter.spans.dropped"])
+
+	// Once exported, the spans leave the queue
+	assert.NoError(t, exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{sampled, sampled}))
+	processor.OnEnd(sampled)
+	assert.Equal(t, 4, inner.ended)
+	assert.Equal(t, 0., rec.Get().Metrics["otel.exporter.spans.dropped"])
+}
+
+func TestErrorClass(t *testing.T) {
+	assert.Equal(t, "export failed #", errorClass(fmt.Errorf("export failed 42")))
+	assert.Equal(t, "batch #.# is lost", errorClass(fmt.Errorf("batch 12.5 is lost")))
+	assert.Equal(t, "failed to upload traces", errorClass(
+		fmt.Errorf("failed to upload traces: %w", fmt.Errorf("connection refused"))))
+	assert.Equal(t, maxErrorClassLen, len(errorClass(errors.New(strings.Repeat("x", 200)))))
+}
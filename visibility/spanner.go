@@ -31,6 +31,7 @@ type wrappedSpan struct {
 	mtx            sync.Mutex
 	storedError    error
 	endedWithError bool
+	fault          bool
 	endOptions     []trace.SpanEndOption
 }
 
@@ -63,6 +64,18 @@ func (s *wrappedSpan) SetStatus(code codes.Code, description string) {
 	s.endedWithError = code == codes.Error
 }
 
+// MarkAsFault makes the span count as a Fault instead of an Error or Success when it's
+// finished, just like a panic does. Use it for the failures that are the service's own
+// fault rather than the caller's, e.g. for the HTTP 5xx responses.
+func MarkAsFault(span trace.Span) {
+	w, ok := span.(*wrappedSpan)
+	utils.PanicIfF(!ok, "Trying to mark a span not created by BeginNewSpan")
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.fault = true
+}
+
 func BeginNewSpan(ctx context.Context, obs *Observer, name string,
 	options ...BeginSpanOption) (trace.Span, context.Context) {
 
@@ -94,34 +107,63 @@ func doBeginNewSpan(ctx context.Context, obs *Observer, config BeginSpanConfig)
 		startCtx = trace.ContextWithSpanContext(startCtx, *config.GraftedParent)
 	}
 
+	startOptions := config.StartSpanOptions
+	if len(obs.DefaultSpanAttributes) != 0 {
+		// Put the defaults first, so that the explicit attributes can override them
+		startOptions = append([]trace.SpanStartOption{trace.WithAttributes(obs.DefaultSpanAttributes...)},
+			startOptions...)
+	}
+
 	_, span := obs.TraceProvider.Tracer(config.LibraryName).Start(
-		startCtx, config.SpanName, config.StartSpanOptions...)
+		startCtx, config.SpanName, startOptions...)
 
 	canary := IsCanaryRequest(ctx)
 	if canary {
 		span.SetAttributes(attribute.Bool(CanaryAttributeName, true))
 	}
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		span.SetAttributes(attribute.String(RequestIDAttributeName, requestID))
+	}
 
 	var mh *MetricHelper
 	if config.AddMetrics {
+		// The helper inherits the tags set by Tag in the parent span, and the tags set inside
+		// this span stay in its helper instead of leaking to the parent and the siblings
 		mh = obs.MakeMetricHelperWithPrefix(ctx, config.MetricPrefix)
+		if len(config.MetricAttributes) != 0 {
+			mh.attrs = appendAttrs(mh.attrs, config.MetricAttributes)
+		}
 		mh.InitCounts(config.MetricNameBase+"Success", config.MetricNameBase+"Error", config.MetricNameBase+"Fault")
 		ctx = ContextWithMetricHelper(ctx, mh)
 	}
 
 	ctx = obs.ContextWithLogger(ctx, config.SpanName, obs.LogFieldsForSpan(span)...)
 
+	if obs.LeakPolicy == LeakPolicyIgnore {
+		config.WithoutLeakCheck = true
+	}
+
+	// The span can be created after the fact with the original start time
+	startConfig := trace.NewSpanStartConfig(startOptions...)
+	startTime := startConfig.Timestamp()
+	if startTime.IsZero() {
+		startTime = time.Now()
+	}
+
 	// Wrap the span
 	w := &wrappedSpan{
 		Span:      span,
 		obs:       obs,
 		cfg:       config,
-		startTime: time.Now(),
+		startTime: startTime,
 		met:       mh,
 		log:       logging.L(ctx),
 
 		panic: func(v any) { panic(v) },
 	}
+	if obs.LeakPolicy == LeakPolicyLog {
+		w.panic = func(v any) { obs.Logger.Error(fmt.Sprint(v)) }
+	}
 
 	if !config.WithoutLeakCheck {
 		armFinalizer(w)
@@ -169,6 +211,8 @@ func doCleanupWithErr(span trace.Span, err error, thrownPanic any) {
 		runtime.SetFinalizer(w, nil)
 	}
 
+	w.logIfSlow()
+
 	successMet := w.cfg.MetricPrefix + w.cfg.MetricNameBase + "Success"
 	errorMet := w.cfg.MetricPrefix + w.cfg.MetricNameBase + "Error"
 	failMet := w.cfg.MetricPrefix + w.cfg.MetricNameBase + "Fault"
@@ -203,7 +247,11 @@ func doCleanupWithErr(span trace.Span, err error, thrownPanic any) {
 	// We have an error that we need to register
 	if err != nil {
 		if w.met != nil {
-			w.met.AddCount(errorMet, 1)
+			if w.fault {
+				w.met.AddCount(failMet, 1)
+			} else {
+				w.met.AddCount(errorMet, 1)
+			}
 			w.met.Close()
 		}
 
@@ -215,7 +263,9 @@ func doCleanupWithErr(span trace.Span, err error, thrownPanic any) {
 
 	// No error passed to this function
 	if w.met != nil {
-		if w.endedWithError || w.storedError != nil {
+		if w.fault {
+			w.met.AddCount(failMet, 1)
+		} else if w.endedWithError || w.storedError != nil {
 			w.met.AddCount(errorMet, 1)
 		} else {
 			w.met.AddCount(successMet, 1)
@@ -226,3 +276,14 @@ func doCleanupWithErr(span trace.Span, err error, thrownPanic any) {
 	// Nothing special needs to be done
 	w.Span.End(w.endOptions...)
 }
+
+func (s *wrappedSpan) logIfSlow() {
+	if s.obs.SlowSpanThreshold == nil {
+		return
+	}
+	threshold := s.obs.SlowSpanThreshold.Load()
+	elapsed := time.Since(s.startTime)
+	if threshold > 0 && elapsed > threshold {
+		s.log.Warn("Slow span", zap.Duration("elapsed", elapsed), zap.Duration("threshold", threshold))
+	}
+}
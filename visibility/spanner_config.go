@@ -1,6 +1,9 @@
 package visibility
 
-import "go.opentelemetry.io/otel/trace"
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
 
 // BeginSpanConfig is used for the span configuration
 type BeginSpanConfig struct {
@@ -8,15 +11,29 @@ type BeginSpanConfig struct {
 	LibraryName      string
 	StartSpanOptions []trace.SpanStartOption
 
-	AddMetrics     bool
-	MetricPrefix   string
-	MetricNameBase string
+	AddMetrics       bool
+	MetricPrefix     string
+	MetricNameBase   string
+	MetricAttributes []attribute.KeyValue
 
 	WithoutLeakCheck bool
 
 	GraftedParent *trace.SpanContext
 }
 
+// SpanLeakPolicy defines what happens when a span created by BeginNewSpan is garbage-collected
+// without being passed to CleanupSpan
+type SpanLeakPolicy int
+
+const (
+	// LeakPolicyPanic panics in the finalizer goroutine, this is the default
+	LeakPolicyPanic SpanLeakPolicy = iota
+	// LeakPolicyLog logs the leak as an error through the Observer's logger
+	LeakPolicyLog
+	// LeakPolicyIgnore turns off the leak checker for all the spans, see WithoutLeakCheck
+	LeakPolicyIgnore
+)
+
 // BeginSpanOption is used to customize the span options
 type BeginSpanOption func(cfg *BeginSpanConfig)
 
@@ -99,6 +116,14 @@ func WithCustomMetricNameBase(base string) BeginSpanOption {
 	}
 }
 
+// WithMetricAttributes adds the attributes to the span metrics, in addition to the
+// Observer's MetricAttributes
+func WithMetricAttributes(attrs ...attribute.KeyValue) BeginSpanOption {
+	return func(cfg *BeginSpanConfig) {
+		cfg.MetricAttributes = append(cfg.MetricAttributes, attrs...)
+	}
+}
+
 // WithoutLeakCheck disables the span leak checker. Leak checker imposes a slight overhead
 // that might be inappropriate for very tight inner loops (but then, why do you want
 // to run them as separate spans?)
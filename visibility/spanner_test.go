@@ -171,3 +171,19 @@ func TestCustomMetricTags(t *testing.T) {
 	assert.Equal(t, "SomeCount", string(span1.Attributes()[0].Key))
 	assert.Equal(t, true, span1.Attributes()[0].Value.AsBool())
 }
+
+func TestSpanLeakPolicyLog(t *testing.T) {
+	ms, log := logging.NewMemorySinkLogger()
+	obs, _ := NewRecordingObserver(log)
+	obs.LeakPolicy = LeakPolicyLog
+
+	func() {
+		_, _ = BeginNewSpan(context.Background(), obs, "Leaked")
+	}()
+	for i := 0; i < 10 && ms.Len() == 0; i++ {
+		runtime.GC() // Make sure finalizers fire
+		runtime.Gosched()
+	}
+
+	assert.True(t, strings.Contains(ms.String(), "A span has not been finalized"))
+}
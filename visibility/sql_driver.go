@@ -0,0 +1,654 @@
+package visibility
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+// SQLConfig is the configuration of the instrumented database/sql driver
+type SQLConfig struct {
+	// The base for the metric names, "SQL" by default
+	MetricNameBase string
+
+	// The "db.system" attribute of the spans and metrics, e.g. "postgresql"
+	DBSystem string
+
+	// Only create the spans for the operations that take at least this long. The metrics
+	// are submitted for all the operations. Zero means that every operation is traced.
+	SlowThreshold time.Duration
+
+	// Additional options for the spans
+	SpanOptions []BeginSpanOption
+}
+
+// SQLOption is used to customize the instrumented driver
+type SQLOption func(cfg *SQLConfig)
+
+// WithSQLMetricNameBase overrides the "SQL" metric name base
+func WithSQLMetricNameBase(base string) SQLOption {
+	return func(cfg *SQLConfig) {
+		cfg.MetricNameBase = base
+	}
+}
+
+// WithDBSystem sets the "db.system" attribute, e.g. "postgresql" or "mysql"
+func WithDBSystem(system string) SQLOption {
+	return func(cfg *SQLConfig) {
+		cfg.DBSystem = system
+	}
+}
+
+// WithSlowQueryThreshold only traces the operations that take at least the threshold
+func WithSlowQueryThreshold(threshold time.Duration) SQLOption {
+	return func(cfg *SQLConfig) {
+		cfg.SlowThreshold = threshold
+	}
+}
+
+// WithSQLSpanOptions adds the options for the spans
+func WithSQLSpanOptions(options ...BeginSpanOption) SQLOption {
+	return func(cfg *SQLConfig) {
+		cfg.SpanOptions = append(cfg.SpanOptions, options...)
+	}
+}
+
+// The operations reported by the instrumented driver
+const (
+	SQLOpQuery    = "Query"
+	SQLOpExec     = "Exec"
+	SQLOpPrepare  = "Prepare"
+	SQLOpBegin    = "Begin"
+	SQLOpCommit   = "Commit"
+	SQLOpRollback = "Rollback"
+)
+
+var rowsAffectedKey = attribute.Key("db.rows_affected")
+
+// WrapDriver wraps the database/sql driver to trace each operation with a span started
+// by BeginNewSpan once the operation completes. Register the result with sql.Register,
+// or use WrapConnector with sql.OpenDB instead.
+//
+// The spans are named "SQL <Operation>" and carry the statement with the literals stripped
+// by SanitizeSQL. The following metrics are submitted for each operation (Query, Exec,
+// Prepare, Begin, Commit and Rollback):
+// <Base><Operation>Success=1 in case the operation succeeds
+// <Base><Operation>Error=1 in case the operation fails
+// <Base><Operation>Fault=1 in case the driver panics
+// <Base><Operation>Latency - the operation time, in milliseconds
+// <Base>ExecRowsAffected - the number of rows affected by the Exec operations
+//
+// The Query span covers the query itself, not the iteration over the returned rows.
+func WrapDriver(obs *Observer, d driver.Driver, options ...SQLOption) driver.Driver {
+	return &instrumentedDriver{inner: d, in: newSQLInstrumentation(obs, options)}
+}
+
+// WrapConnector is the WrapDriver counterpart for sql.OpenDB
+func WrapConnector(obs *Observer, c driver.Connector, options ...SQLOption) driver.Connector {
+	in := newSQLInstrumentation(obs, options)
+	return &instrumentedConnector{
+		inner:  c,
+		driver: &instrumentedDriver{inner: c.Driver(), in: in},
+		in:     in,
+	}
+}
+
+type sqlInstrumentation struct {
+	obs         *Observer
+	cfg         SQLConfig
+	metricAttrs []attribute.KeyValue
+}
+
+func newSQLInstrumentation(obs *Observer, options []SQLOption) *sqlInstrumentation {
+	cfg := SQLConfig{
+		MetricNameBase: "SQL",
+	}
+	for _, o := range options {
+		o(&cfg)
+	}
+
+	in := &sqlInstrumentation{obs: obs, cfg: cfg}
+	if cfg.DBSystem != "" {
+		in.metricAttrs = append(in.metricAttrs, semconv.DBSystemKey.String(cfg.DBSystem))
+	}
+	return in
+}
+
+// observe runs the operation and records it. The span is created after the fact with the
+// original timestamps, once it's known that the operation isn't skipped (and that it's slow,
+// if only the slow operations are traced).
+func (in *sqlInstrumentation) observe(ctx context.Context, op, query string,
+	fn func(ctx context.Context) (rowsAffected int64, err error)) (err error) {
+
+	start := time.Now()
+	rows := int64(-1)
+	defer func() {
+		// recover() only works in the deferred function itself
+		thrownPanic := recover()
+		if thrownPanic == nil && err == driver.ErrSkip {
+			// The operation is retried by database/sql in a different way, it's recorded then
+			return
+		}
+		elapsed := time.Since(start)
+		if thrownPanic == nil && elapsed < in.cfg.SlowThreshold {
+			in.submitMetrics(ctx, op, elapsed, rows, err)
+			return
+		}
+
+		sp, spanCtx := in.beginSpan(ctx, op, query, trace.WithTimestamp(start))
+		in.recordResult(spanCtx, sp, op, elapsed, rows)
+		if thrownPanic == nil {
+			sp.End(trace.WithTimestamp(start.Add(elapsed)))
+		}
+		doCleanupWithErr(sp, err, thrownPanic)
+		if thrownPanic != nil {
+			panic(thrownPanic)
+		}
+	}()
+
+	rows, err = fn(ctx)
+	return err
+}
+
+func (in *sqlInstrumentation) beginSpan(ctx context.Context, op, query string,
+	startOpts ...trace.SpanStartOption) (trace.Span, context.Context) {
+
+	attrs := []attribute.KeyValue{}
+	if in.cfg.DBSystem != "" {
+		attrs = append(attrs, semconv.DBSystemKey.String(in.cfg.DBSystem))
+	}
+	if query != "" {
+		statement := SanitizeSQL(query)
+		attrs = append(attrs, semconv.DBStatementKey.String(statement))
+		if operation, _, _ := strings.Cut(statement, " "); operation != "" {
+			attrs = append(attrs, semconv.DBOperationKey.String(strings.ToUpper(operation)))
+		}
+	}
+	startOpts = append(startOpts, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+
+	spanOpts := []BeginSpanOption{
+		WithMetrics(),
+		WithCustomMetricNameBase(in.cfg.MetricNameBase + op),
+		WithMetricAttributes(in.metricAttrs...),
+		WithSpanStartOptions(startOpts...),
+	}
+	spanOpts = append(spanOpts, in.cfg.SpanOptions...)
+
+	return BeginNewSpan(ctx, in.obs, "SQL "+op, spanOpts...)
+}
+
+func (in *sqlInstrumentation) recordResult(ctx context.Context, sp trace.Span, op string,
+	elapsed time.Duration, rows int64) {
+
+	mh := GetMetricHelperFromContext(ctx)
+	base := in.cfg.MetricNameBase + op
+	mh.Add(Named(base+"Latency", UnitMilliseconds), float64(elapsed)/float64(time.Millisecond))
+	if rows >= 0 {
+		sp.SetAttributes(rowsAffectedKey.Int64(rows))
+		mh.AddCount(base+"RowsAffected", float64(rows))
+	}
+}
+
+// submitMetrics submits the same metrics as the span would, for the operations that are
+// too fast to be traced
+func (in *sqlInstrumentation) submitMetrics(ctx context.Context, op string, elapsed time.Duration,
+	rows int64, err error) {
+
+	mh := in.obs.MakeMetricHelper(ctx)
+	mh.attrs = appendAttrs(mh.attrs, in.metricAttrs)
+
+	base := in.cfg.MetricNameBase + op
+	mh.InitCounts(base+"Success", base+"Error", base+"Fault")
+	if err != nil {
+		mh.AddCount(base+"Error", 1)
+	} else {
+		mh.AddCount(base+"Success", 1)
+	}
+	mh.Add(Named(base+"Latency", UnitMilliseconds), float64(elapsed)/float64(time.Millisecond))
+	if rows >= 0 {
+		mh.AddCount(base+"RowsAffected", float64(rows))
+	}
+	mh.Close()
+}
+
+func resultRowsAffected(res driver.Result) int64 {
+	if res == nil {
+		return -1
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return rows
+}
+
+func namedValuesToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	res := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, fmt.Errorf("the driver does not support the named parameters")
+		}
+		res[i] = nv.Value
+	}
+	return res, nil
+}
+
+type instrumentedConnector struct {
+	inner  driver.Connector
+	driver *instrumentedDriver
+	in     *sqlInstrumentation
+}
+
+func (c *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.inner.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{inner: conn, in: c.in}, nil
+}
+
+func (c *instrumentedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type instrumentedDriver struct {
+	inner driver.Driver
+	in    *sqlInstrumentation
+}
+
+var _ driver.DriverContext = &instrumentedDriver{}
+
+func (d *instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.inner.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{inner: conn, in: d.in}, nil
+}
+
+func (d *instrumentedDriver) OpenConnector(name string) (driver.Connector, error) {
+	var connector driver.Connector = dsnConnector{name: name, driver: d.inner}
+	if dc, ok := d.inner.(driver.DriverContext); ok {
+		var err error
+		connector, err = dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &instrumentedConnector{inner: connector, driver: d, in: d.in}, nil
+}
+
+// dsnConnector is used for the drivers that don't implement driver.DriverContext
+type dsnConnector struct {
+	name   string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.name)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// instrumentedConn implements all the optional interfaces, falling back to the behavior
+// database/sql would use if the wrapped connection doesn't implement them
+type instrumentedConn struct {
+	inner driver.Conn
+	in    *sqlInstrumentation
+}
+
+var (
+	_ driver.ConnPrepareContext = &instrumentedConn{}
+	_ driver.ConnBeginTx        = &instrumentedConn{}
+	_ driver.ExecerContext      = &instrumentedConn{}
+	_ driver.QueryerContext     = &instrumentedConn{}
+	_ driver.Pinger             = &instrumentedConn{}
+	_ driver.SessionResetter    = &instrumentedConn{}
+	_ driver.Validator          = &instrumentedConn{}
+	_ driver.NamedValueChecker  = &instrumentedConn{}
+)
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	err := c.in.observe(ctx, SQLOpPrepare, query, func(ctx context.Context) (int64, error) {
+		var err error
+		if pc, ok := c.inner.(driver.ConnPrepareContext); ok {
+			stmt, err = pc.PrepareContext(ctx, query)
+		} else {
+			stmt, err = c.inner.Prepare(query)
+		}
+		return -1, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{inner: stmt, conn: c, query: query}, nil
+}
+
+func (c *instrumentedConn) Close() error {
+	return c.inner.Close()
+}
+
+func (c *instrumentedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	err := c.in.observe(ctx, SQLOpBegin, "", func(ctx context.Context) (int64, error) {
+		var err error
+		if bt, ok := c.inner.(driver.ConnBeginTx); ok {
+			tx, err = bt.BeginTx(ctx, opts)
+			return -1, err
+		}
+		// The same check as database/sql does for the legacy drivers
+		if opts.Isolation != driver.IsolationLevel(0) || opts.ReadOnly {
+			return -1, fmt.Errorf("the driver does not support non-default isolation level or read-only transactions")
+		}
+		tx, err = c.inner.Begin()
+		return -1, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTx{inner: tx, ctx: ctx, in: c.in}, nil
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+
+	execer, hasCtx := c.inner.(driver.ExecerContext)
+	legacyExecer, hasLegacy := c.inner.(driver.Execer)
+	if !hasCtx && !hasLegacy {
+		// database/sql will prepare the statement and execute it
+		return nil, driver.ErrSkip
+	}
+
+	var res driver.Result
+	err := c.in.observe(ctx, SQLOpExec, query, func(ctx context.Context) (int64, error) {
+		var err error
+		if hasCtx {
+			res, err = execer.ExecContext(ctx, query, args)
+		} else {
+			var values []driver.Value
+			if values, err = namedValuesToValues(args); err == nil {
+				res, err = legacyExecer.Exec(query, values)
+			}
+		}
+		return resultRowsAffected(res), err
+	})
+	return res, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+
+	queryer, hasCtx := c.inner.(driver.QueryerContext)
+	legacyQueryer, hasLegacy := c.inner.(driver.Queryer)
+	if !hasCtx && !hasLegacy {
+		return nil, driver.ErrSkip
+	}
+
+	var rows driver.Rows
+	err := c.in.observe(ctx, SQLOpQuery, query, func(ctx context.Context) (int64, error) {
+		var err error
+		if hasCtx {
+			rows, err = queryer.QueryContext(ctx, query, args)
+		} else {
+			var values []driver.Value
+			if values, err = namedValuesToValues(args); err == nil {
+				rows, err = legacyQueryer.Query(query, values)
+			}
+		}
+		return -1, err
+	})
+	return rows, err
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if p, ok := c.inner.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.inner.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	if v, ok := c.inner.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.inner.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	// Use the default conversion
+	return driver.ErrSkip
+}
+
+type instrumentedTx struct {
+	inner driver.Tx
+	ctx   context.Context
+	in    *sqlInstrumentation
+}
+
+func (t *instrumentedTx) Commit() error {
+	return t.in.observe(t.ctx, SQLOpCommit, "", func(ctx context.Context) (int64, error) {
+		return -1, t.inner.Commit()
+	})
+}
+
+func (t *instrumentedTx) Rollback() error {
+	return t.in.observe(t.ctx, SQLOpRollback, "", func(ctx context.Context) (int64, error) {
+		return -1, t.inner.Rollback()
+	})
+}
+
+type instrumentedStmt struct {
+	inner driver.Stmt
+	conn  *instrumentedConn
+	query string
+}
+
+var (
+	_ driver.StmtExecContext   = &instrumentedStmt{}
+	_ driver.StmtQueryContext  = &instrumentedStmt{}
+	_ driver.NamedValueChecker = &instrumentedStmt{}
+	_ driver.ColumnConverter   = &instrumentedStmt{}
+)
+
+func (s *instrumentedStmt) Close() error {
+	return s.inner.Close()
+}
+
+func (s *instrumentedStmt) NumInput() int {
+	return s.inner.NumInput()
+}
+
+func (s *instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.inner.Exec(args)
+}
+
+func (s *instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.inner.Query(args)
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	err := s.conn.in.observe(ctx, SQLOpExec, s.query, func(ctx context.Context) (int64, error) {
+		var err error
+		if sec, ok := s.inner.(driver.StmtExecContext); ok {
+			res, err = sec.ExecContext(ctx, args)
+		} else {
+			var values []driver.Value
+			if values, err = namedValuesToValues(args); err == nil {
+				res, err = s.inner.Exec(values)
+			}
+		}
+		return resultRowsAffected(res), err
+	})
+	return res, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	err := s.conn.in.observe(ctx, SQLOpQuery, s.query, func(ctx context.Context) (int64, error) {
+		var err error
+		if sqc, ok := s.inner.(driver.StmtQueryContext); ok {
+			rows, err = sqc.QueryContext(ctx, args)
+		} else {
+			var values []driver.Value
+			if values, err = namedValuesToValues(args); err == nil {
+				rows, err = s.inner.Query(values)
+			}
+		}
+		return -1, err
+	})
+	return rows, err
+}
+
+func (s *instrumentedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := s.inner.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+func (s *instrumentedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if cc, ok := s.inner.(driver.ColumnConverter); ok {
+		return cc.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// SanitizeSQL replaces the string and numeric literals in the SQL statement with "?", so
+// that it can be recorded without leaking the data. The comments are removed and the
+// whitespace is collapsed. The quoted identifiers and the placeholders ("?", "$1", ":name")
+// are kept as-is.
+func SanitizeSQL(query string) string {
+	var res strings.Builder
+	res.Grow(len(query))
+
+	isIdent := func(c byte) bool {
+		return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+	}
+	lastIsIdent := func() bool {
+		s := res.String()
+		return len(s) != 0 && isIdent(s[len(s)-1])
+	}
+	space := func() {
+		s := res.String()
+		if len(s) != 0 && s[len(s)-1] != ' ' {
+			res.WriteByte(' ')
+		}
+	}
+	// skipQuoted returns the position after the closing quote, or the end of the query
+	skipQuoted := func(i int, quote byte) int {
+		for i++; i < len(query); i++ {
+			switch {
+			case query[i] == '\\':
+				i++
+			case query[i] == quote && i+1 < len(query) && query[i+1] == quote:
+				i++
+			case query[i] == quote:
+				return i + 1
+			}
+		}
+		return len(query)
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space()
+			i++
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			space()
+			i += end
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			space()
+		case c == '\'':
+			res.WriteByte('?')
+			i = skipQuoted(i, '\'')
+		case (c == 'E' || c == 'e' || c == 'X' || c == 'x' || c == 'B' || c == 'b' || c == 'N' || c == 'n') &&
+			i+1 < len(query) && query[i+1] == '\'' && !lastIsIdent():
+			// The prefixed strings: E'escaped', X'0F', B'101', N'national'
+			res.WriteByte('?')
+			i = skipQuoted(i+1, '\'')
+		case c == '"' || c == '`':
+			end := skipQuoted(i, c)
+			res.WriteString(query[i:end])
+			i = end
+		case c == '$' && !lastIsIdent() && i+1 < len(query) && !(query[i+1] >= '0' && query[i+1] <= '9'):
+			// The PostgreSQL dollar-quoted strings: $$text$$ or $tag$text$tag$
+			end := strings.IndexByte(query[i+1:], '$')
+			if end < 0 {
+				res.WriteByte(c)
+				i++
+				continue
+			}
+			tag := query[i : i+end+2]
+			if strings.ContainsAny(tag[1:len(tag)-1], " \t\n\r'\"") {
+				res.WriteByte(c)
+				i++
+				continue
+			}
+			closing := strings.Index(query[i+len(tag):], tag)
+			res.WriteByte('?')
+			if closing < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + closing + len(tag)
+			}
+		case (c >= '0' && c <= '9' || c == '.' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9') &&
+			!lastIsIdent():
+			// A numeric literal, including 0x1F, 1.5e-3 and .5
+			hex := strings.HasPrefix(query[i:], "0x") || strings.HasPrefix(query[i:], "0X")
+			for i++; i < len(query); i++ {
+				n := query[i]
+				if (n == '+' || n == '-') && (query[i-1] == 'e' || query[i-1] == 'E') && !hex {
+					continue
+				}
+				if !(n == '.' || isIdent(n)) || n == '$' {
+					break
+				}
+			}
+			res.WriteByte('?')
+		default:
+			res.WriteByte(c)
+			i++
+		}
+	}
+
+	return strings.TrimSpace(res.String())
+}
@@ -0,0 +1,275 @@
+package visibility
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSQLDriver fails the statements containing "fail" and sleeps for the ones
+// containing "slow", the statements containing "skip" can only be prepared
+type fakeSQLDriver struct{}
+
+func (fakeSQLDriver) Open(string) (driver.Conn, error) {
+	return &fakeSQLConn{}, nil
+}
+
+type fakeSQLConnector struct{}
+
+func (fakeSQLConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeSQLConn{}, nil
+}
+
+func (fakeSQLConnector) Driver() driver.Driver {
+	return fakeSQLDriver{}
+}
+
+type fakeSQLConn struct{}
+
+func runFakeStatement(query string) error {
+	if strings.Contains(query, "slow") {
+		time.Sleep(30 * time.Millisecond)
+	}
+	if strings.Contains(query, "fail") {
+		return fmt.Errorf("syntax error")
+	}
+	return nil
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return fakeSQLTx{}, nil
+}
+
+func (c *fakeSQLConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if strings.Contains(query, "skip") {
+		// Make database/sql prepare the statement instead
+		return nil, driver.ErrSkip
+	}
+	if err := runFakeStatement(query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(3), nil
+}
+
+func (c *fakeSQLConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if err := runFakeStatement(query); err != nil {
+		return nil, err
+	}
+	return &fakeSQLRows{left: 1}, nil
+}
+
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error {
+	return nil
+}
+
+func (fakeSQLTx) Rollback() error {
+	return fmt.Errorf("already committed")
+}
+
+// fakeSQLStmt only implements the legacy interface
+type fakeSQLStmt struct {
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s *fakeSQLStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeSQLStmt) Exec([]driver.Value) (driver.Result, error) {
+	if err := runFakeStatement(s.query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeSQLStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &fakeSQLRows{left: 1}, nil
+}
+
+type fakeSQLRows struct {
+	left int
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{"n"}
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if r.left == 0 {
+		return io.EOF
+	}
+	r.left--
+	dest[0] = int64(42)
+	return nil
+}
+
+func TestSanitizeSQL(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM users WHERE id = 42":                               "SELECT * FROM users WHERE id = ?",
+		"SELECT * FROM t WHERE name = 'O''Brien' AND x = 'a\\'b'":         "SELECT * FROM t WHERE name = ? AND x = ?",
+		"INSERT INTO t2 (a, b) VALUES (1.5e-3, -.5), (0x1F, $1)":          "INSERT INTO t2 (a, b) VALUES (?, -?), (?, $1)",
+		"SELECT \"col 1\", `col2` FROM t -- secret: 123\nWHERE a = :name": "SELECT \"col 1\", `col2` FROM t WHERE a = :name",
+		"UPDATE t /* 'comment' */ SET  a =\n\tE'x\\n', b = X'0F'":         "UPDATE t SET a = ?, b = ?",
+		"SELECT $$it's $1$$, $tag$text$tag$ FROM t":                       "SELECT ?, ? FROM t",
+		"SELECT 'unterminated":                                            "SELECT ?",
+	}
+	for query, expected := range cases {
+		assert.Equal(t, expected, SanitizeSQL(query), query)
+	}
+}
+
+func TestSQLDriver(t *testing.T) {
+	obs, rec := NewDeltaRecordingObserver(zap.NewNop())
+	defer obs.Shutdown(context.Background())
+
+	db := sql.OpenDB(WrapConnector(obs, fakeSQLConnector{}, WithDBSystem("postgresql")))
+	defer db.Close()
+
+	parent, ctx := BeginNewSpan(context.Background(), obs, "Parent")
+	res, err := db.ExecContext(ctx, "UPDATE t SET a = 'secret' WHERE id = 42")
+	assert.NoError(t, err)
+	rows, _ := res.RowsAffected()
+	assert.Equal(t, int64(3), rows)
+	CleanupSpan(parent)
+
+	values := rec.Get()
+	assert.Equal(t, 2, len(values.Spans))
+	span := values.Spans[0]
+	assert.Equal(t, "SQL Exec", span.Name())
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind())
+	assert.Equal(t, values.Spans[1].SpanContext().SpanID(), span.Parent().SpanID())
+
+	attrs := attribute.NewSet(span.Attributes()...)
+	statement, _ := attrs.Value("db.statement")
+	assert.Equal(t, "UPDATE t SET a = ? WHERE id = ?", statement.AsString())
+	operation, _ := attrs.Value("db.operation")
+	assert.Equal(t, "UPDATE", operation.AsString())
+	system, _ := attrs.Value("db.system")
+	assert.Equal(t, "postgresql", system.AsString())
+	affected, _ := attrs.Value("db.rows_affected")
+	assert.Equal(t, int64(3), affected.AsInt64())
+
+	assert.Equal(t, 1., values.Metrics["SQLExecSuccess"])
+	assert.Equal(t, 3., values.Metrics["SQLExecRowsAffected"])
+	assert.Equal(t, 1., values.Metrics["SQLExecLatency_num"])
+
+	var n int
+	assert.NoError(t, db.QueryRowContext(ctx, "SELECT 1").Scan(&n))
+	assert.Equal(t, 42, n)
+	_, err = db.QueryContext(ctx, "SELECT fail")
+	assert.ErrorContains(t, err, "syntax error")
+
+	values = rec.Get()
+	assert.Equal(t, 1., values.Metrics["SQLQuerySuccess"])
+	assert.Equal(t, 1., values.Metrics["SQLQueryError"])
+	assert.Equal(t, codes.Error, values.Spans[1].Status().Code)
+
+	// The transactions and prepared statements
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NoError(t, err)
+	stmt, err := tx.PrepareContext(ctx, "DELETE FROM t WHERE id = ?")
+	assert.NoError(t, err)
+	_, err = stmt.ExecContext(ctx, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+
+	values = rec.Get()
+	var names []string
+	for _, s := range values.Spans {
+		names = append(names, s.Name())
+	}
+	assert.Equal(t, []string{"SQL Begin", "SQL Prepare", "SQL Exec", "SQL Commit"}, names)
+	assert.Equal(t, 1., values.Metrics["SQLBeginSuccess"])
+	assert.Equal(t, 1., values.Metrics["SQLPrepareSuccess"])
+	assert.Equal(t, 1., values.Metrics["SQLExecRowsAffected"])
+	assert.Equal(t, 1., values.Metrics["SQLCommitSuccess"])
+
+	// The skipped attempt has no span, only the prepared statement is traced
+	_, err = db.ExecContext(ctx, "DELETE FROM skip")
+	assert.NoError(t, err)
+
+	values = rec.Get()
+	names = nil
+	for _, s := range values.Spans {
+		names = append(names, s.Name())
+	}
+	assert.Equal(t, []string{"SQL Prepare", "SQL Exec"}, names)
+	assert.Equal(t, 1., values.Metrics["SQLExecSuccess"])
+	assert.Equal(t, 1., values.Metrics["SQLExecRowsAffected"])
+}
+
+func TestSQLDriverSlowQueries(t *testing.T) {
+	sink, logger := logging.NewMemorySinkLogger()
+	obs, rec := NewDeltaRecordingObserver(logger)
+	defer obs.Shutdown(context.Background())
+	obs.SlowSpanThreshold.Store(25 * time.Millisecond)
+
+	connector, err := WrapDriver(obs, fakeSQLDriver{}, WithSlowQueryThreshold(20*time.Millisecond),
+		WithSQLMetricNameBase("DB")).(driver.DriverContext).OpenConnector("dsn")
+	assert.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	// The fast queries only submit the metrics
+	_, err = db.Exec("DELETE FROM fast")
+	assert.NoError(t, err)
+	_, err = db.Exec("DELETE FROM fail")
+	assert.Error(t, err)
+
+	values := rec.Get()
+	assert.Empty(t, values.Spans)
+	assert.Equal(t, 1., values.Metrics["DBExecSuccess"])
+	assert.Equal(t, 1., values.Metrics["DBExecError"])
+	assert.Equal(t, 3., values.Metrics["DBExecRowsAffected"])
+
+	// The skipped attempt is not recorded, only the prepared statement is
+	_, err = db.Exec("DELETE FROM skip")
+	assert.NoError(t, err)
+	values = rec.Get()
+	assert.Equal(t, 1., values.Metrics["DBExecSuccess"])
+	assert.Equal(t, 1., values.Metrics["DBExecRowsAffected"])
+	assert.Empty(t, sink.String())
+
+	before := time.Now()
+	_, err = db.Exec("DELETE FROM slow")
+	assert.NoError(t, err)
+
+	values = rec.Get()
+	assert.Equal(t, 1, len(values.Spans))
+	span := values.Spans[0]
+	assert.Equal(t, "SQL Exec", span.Name())
+	// The span has the real timing of the operation
+	assert.False(t, span.StartTime().Before(before))
+	assert.GreaterOrEqual(t, span.EndTime().Sub(span.StartTime()), 20*time.Millisecond)
+	assert.Equal(t, 1., values.Metrics["DBExecSuccess"])
+	assert.True(t, strings.Contains(sink.String(), `"msg":"Slow span"`))
+}
@@ -0,0 +1,147 @@
+package visibility
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnitBytesUCUM is the UCUM byte unit used by OTel, the Prometheus exporter translates it
+// into the "bytes" suffix. It's interchangeable with UnitBytes.
+const UnitBytesUCUM = "By"
+
+type unitInfo struct {
+	// The base unit of the dimension, the units are only convertible within it
+	base string
+	// The size of the unit in the smallest units of the dimension (e.g. in nanoseconds),
+	// the integer factors keep the conversions exact
+	factor float64
+}
+
+var knownUnits = map[string]unitInfo{
+	Dimensionless: {Dimensionless, 1},
+
+	UnitNanoseconds:  {UnitSeconds, 1},
+	UnitMicroseconds: {UnitSeconds, 1e3},
+	UnitMilliseconds: {UnitSeconds, 1e6},
+	UnitSeconds:      {UnitSeconds, 1e9},
+	UnitMinutes:      {UnitSeconds, 60 * 1e9},
+	UnitHours:        {UnitSeconds, 3600 * 1e9},
+	UnitDays:         {UnitSeconds, 86400 * 1e9},
+
+	UnitBytes:     {UnitBytesUCUM, 1},
+	UnitBytesUCUM: {UnitBytesUCUM, 1},
+	UnitKiloBytes: {UnitBytesUCUM, 1e3},
+	UnitMegaBytes: {UnitBytesUCUM, 1e6},
+	UnitGigaBytes: {UnitBytesUCUM, 1e9},
+	UnitTeraBytes: {UnitBytesUCUM, 1e12},
+	UnitKibiBytes: {UnitBytesUCUM, 1 << 10},
+	UnitMebiBytes: {UnitBytesUCUM, 1 << 20},
+	UnitGibiBytes: {UnitBytesUCUM, 1 << 30},
+	UnitTibiBytes: {UnitBytesUCUM, 1 << 40},
+
+	UnitBytesSec:         {UnitBytesUCUM + "/s", 1},
+	UnitBytesUCUM + "/s": {UnitBytesUCUM + "/s", 1},
+	UnitKiloBytesSec:     {UnitBytesUCUM + "/s", 1e3},
+	UnitMegaBytesSec:     {UnitBytesUCUM + "/s", 1e6},
+	UnitGigaBytesSec:     {UnitBytesUCUM + "/s", 1e9},
+	UnitTeraBytesSec:     {UnitBytesUCUM + "/s", 1e12},
+	UnitKibiBytesSec:     {UnitBytesUCUM + "/s", 1 << 10},
+	UnitMebiBytesSec:     {UnitBytesUCUM + "/s", 1 << 20},
+	UnitGibiBytesSec:     {UnitBytesUCUM + "/s", 1 << 30},
+	UnitTibiBytesSec:     {UnitBytesUCUM + "/s", 1 << 40},
+
+	UnitMetersPerSec: {UnitMetersPerSec, 1},
+	UnitMeters:       {UnitMeters, 1},
+	UnitVolts:        {UnitVolts, 1},
+	UnitAmperes:      {UnitAmperes, 1},
+	UnitJoules:       {UnitJoules, 1},
+	UnitWatts:        {UnitWatts, 1},
+	UnitGrams:        {UnitGrams, 1},
+	UnitCelsius:      {UnitCelsius, 1},
+	UnitHertz:        {UnitHertz, 1},
+	UnitPercent:      {UnitPercent, 1},
+	UnitDollars:      {UnitDollars, 1},
+}
+
+// isAnnotation checks for the UCUM annotations like "{requests}", they are dimensionless
+// and are only compatible with the same annotation
+func isAnnotation(unit string) bool {
+	return len(unit) > 2 && strings.HasPrefix(unit, "{") && strings.HasSuffix(unit, "}") &&
+		!strings.ContainsAny(unit[1:len(unit)-1], "{}")
+}
+
+func lookupUnit(unit string) (unitInfo, bool) {
+	if info, ok := knownUnits[unit]; ok {
+		return info, true
+	}
+	if isAnnotation(unit) {
+		return unitInfo{unit, 1}, true
+	}
+	return unitInfo{}, false
+}
+
+// ValidateUnit checks that the unit is one of the units defined in units.go, "By" (and "By/s"),
+// or a UCUM annotation like "{requests}"
+func ValidateUnit(unit string) error {
+	if _, ok := lookupUnit(unit); !ok {
+		return fmt.Errorf("unknown unit: %q", unit)
+	}
+	return nil
+}
+
+// BaseUnit returns the base unit of the unit's dimension (e.g. "s" for "ms", "By" for "KiBy"),
+// the unknown units are returned as is
+func BaseUnit(unit string) string {
+	if info, ok := lookupUnit(unit); ok {
+		return info.base
+	}
+	return unit
+}
+
+// ConvertUnit converts the value between the units of the same dimension
+func ConvertUnit(val float64, from, to string) (float64, error) {
+	fromInfo, ok := lookupUnit(from)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit: %q", from)
+	}
+	toInfo, ok := lookupUnit(to)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit: %q", to)
+	}
+	if fromInfo.base != toInfo.base {
+		return 0, fmt.Errorf("incompatible units: %q and %q", from, to)
+	}
+	if fromInfo.factor == toInfo.factor {
+		return val, nil
+	}
+	return val * fromInfo.factor / toInfo.factor, nil
+}
+
+// Quantity is a value with its unit
+type Quantity struct {
+	Value float64
+	Unit  string
+}
+
+// In converts the quantity to the compatible unit
+func (q Quantity) In(unit string) (Quantity, error) {
+	val, err := ConvertUnit(q.Value, q.Unit, unit)
+	if err != nil {
+		return Quantity{}, err
+	}
+	return Quantity{Value: val, Unit: unit}, nil
+}
+
+// Normalized converts the quantity to the base unit (e.g. "s" or "By"), the quantities
+// with the unknown units are returned as is
+func (q Quantity) Normalized() Quantity {
+	res, err := q.In(BaseUnit(q.Unit))
+	if err != nil {
+		return q
+	}
+	return res
+}
+
+func (q Quantity) String() string {
+	return fmt.Sprintf("%g %s", q.Value, q.Unit)
+}
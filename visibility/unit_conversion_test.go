@@ -0,0 +1,46 @@
+package visibility
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUnitConversion(t *testing.T) {
+	for _, unit := range []string{Dimensionless, UnitBytes, UnitBytesUCUM, UnitKibiBytesSec, UnitDays,
+		UnitNanoseconds, UnitDollars, "{requests}", "By/s"} {
+		assert.NoError(t, ValidateUnit(unit), unit)
+	}
+	for _, unit := range []string{"", "bytes", "Ms", "{}", "{a}b", "{a{b}"} {
+		assert.ErrorContains(t, ValidateUnit(unit), "unknown unit", unit)
+	}
+
+	val, err := ConvertUnit(1.5, UnitKibiBytes, UnitBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, 1536.0, val)
+	val, err = ConvertUnit(2500, UnitMicroseconds, UnitMilliseconds)
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, val)
+	val, err = ConvertUnit(2, UnitMegaBytesSec, UnitKiloBytesSec)
+	assert.NoError(t, err)
+	assert.Equal(t, 2000.0, val)
+
+	_, err = ConvertUnit(1, UnitSeconds, UnitBytes)
+	assert.ErrorContains(t, err, `incompatible units: "s" and "B"`)
+	_, err = ConvertUnit(1, "{requests}", "{errors}")
+	assert.Error(t, err)
+	_, err = ConvertUnit(1, "parsecs", UnitMeters)
+	assert.ErrorContains(t, err, `unknown unit: "parsecs"`)
+
+	assert.Equal(t, Quantity{Value: 0.25, Unit: UnitSeconds},
+		Quantity{Value: 250, Unit: UnitMilliseconds}.Normalized())
+	assert.Equal(t, Quantity{Value: 2048, Unit: UnitBytesUCUM},
+		Quantity{Value: 2, Unit: UnitKibiBytes}.Normalized())
+	assert.Equal(t, Quantity{Value: 3, Unit: UnitBytesUCUM + "/s"},
+		Quantity{Value: 3, Unit: UnitBytesSec}.Normalized())
+	assert.Equal(t, Quantity{Value: 3, Unit: UnitPercent}, Quantity{Value: 3, Unit: UnitPercent}.Normalized())
+
+	q, err := Quantity{Value: 90, Unit: UnitMinutes}.In(UnitHours)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.5 h", q.String())
+	assert.Equal(t, UnitSeconds, BaseUnit(UnitDays))
+}